@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -24,6 +31,20 @@ func TestIntegrationPositive(t *testing.T) {
 			log.Println(err.Error())
 		}
 	}()
+	// Тестовый origin работает на localhost, поэтому частные адреса разрешены.
+	// Кэш каждый раз новый, иначе повторный прогон получит превью из кэша.
+	dir, err := ioutil.TempDir("", "previewer.")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf, err := ioutil.TempFile("", "previewer.conf.")
+	require.NoError(t, err)
+	defer os.Remove(conf.Name())
+	_, err = conf.WriteString("[Origin]\nAllowPrivate = true\n" +
+		"[Cache]\nStoragePath = " + strconv.Quote(filepath.Join(dir, "cache")) + "\n" +
+		"[Log]\nFile = " + strconv.Quote(filepath.Join(dir, "previewer.log")) + "\n")
+	require.NoError(t, err)
+	require.NoError(t, conf.Close())
+	*ConfigFile = conf.Name()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	go func(ctx context.Context) {
 		main()
@@ -31,7 +52,7 @@ func TestIntegrationPositive(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// Реализовать тесты логики приложения (ресайзы по разным требованиям):
-	wg.Add(18)
+	wg.Add(25)
 	t.Run("test static", func(t *testing.T) {
 		defer wg.Done()
 		body, resp, err := request("http://localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second)
@@ -61,8 +82,11 @@ func TestIntegrationPositive(t *testing.T) {
 		defer wg.Done()
 		body, resp, err := request("http://localhost:8080/fill/480/320/localhost:"+testPort+"/test.gif", 15*time.Second)
 		require.NoError(t, err)
-		fSize := 34508
+		fSize := 91829
 		require.InDelta(t, len(body), fSize, float64(fSize/100)*2, "File size should be about "+strconv.Itoa(fSize/1024)+"Kb~2%")
+		g, err := gif.DecodeAll(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Len(t, g.Image, 2, "Animation must be kept")
 		require.Equal(t, 200, resp.StatusCode)
 		require.Equal(t, resp.Header.Get("X-From-Appcache"), "")
 	})
@@ -88,8 +112,11 @@ func TestIntegrationPositive(t *testing.T) {
 		defer wg.Done()
 		body, resp, err := request("http://localhost:8080/fill/200/200/localhost:"+testPort+"/test.gif", 15*time.Second)
 		require.NoError(t, err)
-		fSize := 11913
+		fSize := 45548
 		require.InDelta(t, len(body), fSize, float64(fSize/100)*2, "File size should be about "+strconv.Itoa(fSize/1024)+"Kb~2%")
+		g, err := gif.DecodeAll(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Len(t, g.Image, 2, "Animation must be kept")
 		require.Equal(t, 200, resp.StatusCode)
 		require.Equal(t, resp.Header.Get("X-From-Appcache"), "")
 	})
@@ -156,6 +183,79 @@ func TestIntegrationPositive(t *testing.T) {
 		require.Equal(t, 200, resp.StatusCode)
 		require.Equal(t, resp.Header.Get("X-From-Appcache"), "")
 	})
+	t.Run("fit JPEG into 300x300", func(t *testing.T) {
+		defer wg.Done()
+		body, resp, err := request("http://localhost:8080/fit/300/300/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 300, cfg.Width)
+		require.Equal(t, 148, cfg.Height)
+	})
+	t.Run("fit-in JPEG into 300x300", func(t *testing.T) {
+		defer wg.Done()
+		body, resp, err := request("http://localhost:8080/fit-in/300/300/bg:000000/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 300, cfg.Width)
+		require.Equal(t, 300, cfg.Height)
+	})
+	t.Run("stretch JPEG to 300x300", func(t *testing.T) {
+		defer wg.Done()
+		body, resp, err := request("http://localhost:8080/stretch/300/300/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 300, cfg.Width)
+		require.Equal(t, 300, cfg.Height)
+	})
+	t.Run("crop JPEG region 100x200", func(t *testing.T) {
+		defer wg.Done()
+		body, resp, err := request("http://localhost:8080/crop/10/20/100/200/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 100, cfg.Width)
+		require.Equal(t, 200, cfg.Height)
+	})
+	t.Run("WebP for client accepting it", func(t *testing.T) {
+		defer wg.Done()
+		header := http.Header{"Accept": []string{"image/webp,*/*;q=0.8"}}
+		body, resp, err := requestWithHeader("http://localhost:8080/fit/300/300/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second, header)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.Equal(t, "image/webp", resp.Header.Get("Content-Type"))
+		require.Equal(t, "Accept", resp.Header.Get("Vary"))
+		cfg, err := webp.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 300, cfg.Width)
+	})
+	t.Run("JPEG for client rejecting WebP", func(t *testing.T) {
+		defer wg.Done()
+		header := http.Header{"Accept": []string{"image/webp;q=0,*/*"}}
+		body, resp, err := requestWithHeader("http://localhost:8080/fit/300/300/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second, header)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.Equal(t, "Accept", resp.Header.Get("Vary"))
+		_, err = jpeg.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+	})
+	t.Run("explicit PNG format from JPEG origin", func(t *testing.T) {
+		defer wg.Done()
+		header := http.Header{"Accept": []string{"image/webp"}}
+		body, resp, err := requestWithHeader("http://localhost:8080/fit/300/300/format:png/q:50/localhost:"+testPort+"/gopher_original_1024x504.jpg", 15*time.Second, header)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		cfg, err := png.DecodeConfig(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 300, cfg.Width)
+	})
 	t.Run("remote server not exist (502 Bad request)", func(t *testing.T) {
 		defer wg.Done()
 		_, resp, err := request("http://localhost:8080/fill/1024/252/abracadabra/fakepic.jpg", 15*time.Second)
@@ -194,12 +294,19 @@ func TestIntegrationPositive(t *testing.T) {
 }
 
 func request(addr string, timeout time.Duration) ([]byte, *http.Response, error) {
+	return requestWithHeader(addr, timeout, nil)
+}
+
+func requestWithHeader(addr string, timeout time.Duration, header http.Header) ([]byte, *http.Response, error) {
 	client := &http.Client{}
 	ctx, _ := context.WithTimeout(context.Background(), timeout)
 	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
 	if err != nil {
 		return nil, nil, err
 	}
+	if header != nil {
+		req.Header = header
+	}
 	req.Close = true
 	res, err := client.Do(req)
 	if err != nil {
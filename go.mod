@@ -4,11 +4,14 @@ go 1.14
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/amitrai48/logger v0.0.0-20190214092904-448001c055ec
 	github.com/anthonynsimon/bild v0.13.0
+	github.com/go-redis/redis/v8 v8.4.11
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 	mvdan.cc/gofumpt v0.0.0-20201107090320-a024667a00f1 // indirect
 )
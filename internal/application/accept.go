@@ -0,0 +1,31 @@
+package application
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptsWebP сообщает, разрешает ли заголовок Accept ответ в формате WebP.
+// Учитывается только явный image/webp: маски */* и image/* присылают и
+// клиенты, которые WebP не умеют. Значение q=0 означает запрет.
+func acceptsWebP(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "image/webp") {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		return q > 0
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package application
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func TestAcceptsWebP(t *testing.T) {
+	table := []struct {
+		header   string
+		expected bool
+		msg      string
+	}{
+		{header: "", msg: "Empty header"},
+		{header: "*/*", msg: "Any type"},
+		{header: "image/*,*/*;q=0.8", msg: "Any image"},
+		{header: "image/avif,image/webp,image/apng,*/*;q=0.8", expected: true, msg: "Chrome"},
+		{header: "image/webp;q=0.5, image/jpeg", expected: true, msg: "Non-zero q"},
+		{header: "image/webp;q=0, */*", msg: "Rejected with q=0"},
+		{header: "image/webp; q=0.0", msg: "Rejected with q=0.0"},
+		{header: "IMAGE/WebP", expected: true, msg: "Case insensitive"},
+		{header: "image/webp;q=abc", msg: "Broken q"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			require.Equal(t, dat.expected, acceptsWebP(dat.header), dat.msg)
+		})
+	}
+}
+
+func TestHandlerNegotiation(t *testing.T) {
+	static := testPic(t)
+	frame := func(c color.Color) *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{c})
+	}
+	var animated bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&animated, &gif.GIF{
+		Image: []*image.Paletted{frame(color.Black), frame(color.White)},
+		Delay: []int{10, 10},
+	}))
+	origin, _ := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/anim.gif" {
+			_, _ = w.Write(animated.Bytes())
+			return
+		}
+		_, _ = w.Write(static)
+	})
+
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, newTestCache(t), newScheduler(1, 10, time.Second))
+	get := func(path string, webp bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if webp {
+			r.Header.Set("Accept", "image/webp,*/*")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+
+	table := []struct {
+		path    string
+		vary    bool
+		sharedX string // X-Cache второго запроса от клиента без WebP
+		msg     string
+	}{
+		{path: "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg"), vary: true, sharedX: "MISS", msg: "Negotiated format"},
+		{path: "/fill/32/32/format:png/" + url.PathEscape(origin.URL+"/pic.jpg"), sharedX: "HIT", msg: "Explicit format"},
+		{path: "/fill/32/32/" + url.PathEscape(origin.URL+"/anim.gif"), vary: true, sharedX: "HIT", msg: "Animation stays GIF"},
+	}
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			w := get(dat.path, true)
+			require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+			require.Equal(t, dat.vary, w.Header().Get("Vary") == "Accept")
+			require.Equal(t, dat.sharedX, get(dat.path, false).Header().Get("X-Cache"))
+			require.Equal(t, "HIT", get(dat.path, true).Header().Get("X-Cache"))
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package application
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/tiburon-777/OTUS_Project/internal/cache"
 	"github.com/tiburon-777/OTUS_Project/internal/config"
@@ -12,9 +16,40 @@ import (
 
 type App struct {
 	*http.Server
-	Log   logger.Interface
-	Cache cache.Cache
-	Conf  config.Config
+	admin   *http.Server // nil, если AdminAddress не задан
+	Log     logger.Interface
+	Cache   cache.Cache
+	Conf    config.Config
+	origin  *originPolicy
+	headers *headerPolicy
+	client  *http.Client
+	sched   *scheduler
+}
+
+// currentScheduler - планировщик, чьи метрики публикуются в expvar как "converter".
+var currentScheduler atomic.Value
+
+// currentCache - кэш, чьи счетчики публикуются в expvar как "cache".
+var currentCache atomic.Value
+
+// statsCache - кэш, считающий попадания по уровням.
+type statsCache interface {
+	Stats() cache.Stats
+}
+
+func init() {
+	expvar.Publish("converter", expvar.Func(func() interface{} {
+		if s, ok := currentScheduler.Load().(*scheduler); ok {
+			return s.stats()
+		}
+		return nil
+	}))
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		if c, ok := currentCache.Load().(statsCache); ok {
+			return c.Stats()
+		}
+		return nil
+	}))
 }
 
 func New(conf config.Config) (*App, error) {
@@ -22,24 +57,83 @@ func New(conf config.Config) (*App, error) {
 	if err != nil {
 		return nil, fmt.Errorf("can't start logger:\n %w", err)
 	}
-	c, err := cache.NewCache(conf.Cache.Capacity, conf.Cache.StoragePath)
+	c, err := cache.New(cache.Options{
+		Capacity:    conf.Cache.Capacity,
+		MaxBytes:    conf.Cache.MaxBytes,
+		Path:        conf.Cache.StoragePath,
+		Index:       conf.Cache.Index,
+		Shards:      conf.Cache.Shards,
+		Policy:      conf.Cache.Policy,
+		Admission:   conf.Cache.Admission,
+		MemoryBytes: conf.Cache.MemoryBytes,
+
+		Backend:       conf.Cache.Backend,
+		RedisAddr:     conf.Cache.RedisAddr,
+		RedisPassword: conf.Cache.RedisPassword,
+		RedisDB:       conf.Cache.RedisDB,
+		Prefix:        conf.Cache.Prefix,
+		TTL:           time.Duration(conf.Cache.MaxTTL) * time.Second,
+		MaxValueBytes: conf.Cache.MaxValueBytes,
+
+		S3Endpoint:  conf.Cache.S3Endpoint,
+		S3Region:    conf.Cache.S3Region,
+		S3Bucket:    conf.Cache.S3Bucket,
+		S3AccessKey: conf.Cache.S3AccessKey,
+		S3SecretKey: conf.Cache.S3SecretKey,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("can't start cache:\n %w", err)
 	}
-	return &App{Server: &http.Server{Addr: net.JoinHostPort(conf.Server.Address, conf.Server.Port)}, Log: loger, Cache: c, Conf: conf}, nil
+	origin, err := newOriginPolicy(conf)
+	if err != nil {
+		return nil, fmt.Errorf("can't create origin policy:\n %w", err)
+	}
+	headers, err := newHeaderPolicy(conf)
+	if err != nil {
+		return nil, fmt.Errorf("can't create header policy:\n %w", err)
+	}
+	sched := newScheduler(conf.Converter.Workers, conf.Converter.QueueSize, time.Duration(conf.Converter.QueueTimeout)*time.Second)
+	currentScheduler.Store(sched)
+	if sc, ok := c.(statsCache); ok {
+		currentCache.Store(sc)
+	}
+	app := &App{
+		Server: &http.Server{Addr: net.JoinHostPort(conf.Server.Address, conf.Server.Port)},
+		Log:    loger, Cache: c, Conf: conf,
+		origin: origin, headers: headers, client: newOriginClient(conf, origin), sched: sched,
+	}
+	if conf.Server.AdminAddress != "" {
+		app.admin = &http.Server{Addr: conf.Server.AdminAddress, Handler: metricsHandler()}
+	}
+	return app, nil
 }
 
 func (s *App) Start() error {
 	s.Log.Infof("Server starting")
-	s.Handler = loggingMiddleware(handler(s.Cache, s.Conf, s.Log), s.Log)
+	s.Handler = loggingMiddleware(handler(s.Cache, s.Conf, s.Log, s.origin, s.headers, s.client, s.sched), s.Log)
+	if s.admin != nil {
+		go func() {
+			if err := s.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.Log.Errorf("admin server failed: " + err.Error())
+			}
+		}()
+	}
 	err := s.ListenAndServe()
 	s.Log.Infof("Server stoped")
 	return err
 }
 
 func (s *App) Stop() error {
+	if s.admin != nil {
+		if err := s.admin.Close(); err != nil {
+			return fmt.Errorf("can't close admin server:\n %w", err)
+		}
+	}
 	if err := s.Close(); err != nil {
 		return err
 	}
+	if err := s.Cache.Close(); err != nil {
+		return fmt.Errorf("can't close cache:\n %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,35 @@
+package application
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+// newOriginClient создает общий для всех запросов клиент к origin'ам. Соединения
+// переиспользуются между запросами; адреса и редиректы проверяются политикой p.
+func newOriginClient(conf config.Config, p *originPolicy) *http.Client {
+	q := conf.Query
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(q.DialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		// Прокси не используется: иначе проверялся бы адрес прокси, а не origin'а.
+		Proxy:                 nil,
+		DialContext:           p.dialContext(dialer),
+		ForceAttemptHTTP2:     q.HTTP2,
+		MaxIdleConns:          q.MaxIdleConns,
+		MaxIdleConnsPerHost:   q.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(q.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(q.TLSHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(q.ResponseHeaderTimeout) * time.Second,
+	}
+	return &http.Client{
+		Timeout:       time.Duration(q.Timeout) * time.Second,
+		Transport:     transport,
+		CheckRedirect: p.checkRedirect,
+	}
+}
@@ -0,0 +1,94 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+// countingOrigin - локальный origin, считающий новые TCP-соединения.
+func countingOrigin(tb testing.TB) (*httptest.Server, *int64) {
+	var conns int64
+	pic := bytes.Repeat([]byte("x"), 16<<10)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pic)
+	}))
+	origin.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	origin.Start()
+	return origin, &conns
+}
+
+func originQuery(tb testing.TB, origin *httptest.Server) Query {
+	u, err := url.Parse(origin.URL + "/pic.jpg")
+	require.NoError(tb, err)
+	return Query{URL: u}
+}
+
+func testClient(tb testing.TB) *http.Client {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Origin.AllowPrivate = true
+	p, err := newOriginPolicy(conf)
+	require.NoError(tb, err)
+	return newOriginClient(conf, p)
+}
+
+func TestOriginClientReusesConnections(t *testing.T) {
+	origin, conns := countingOrigin(t)
+	defer origin.Close()
+	q := originQuery(t, origin)
+	client := testClient(t)
+
+	for i := 0; i < 10; i++ {
+		body, res, err := q.fromOrigin(context.Background(), client, http.Header{}, 0, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Len(t, body, 16<<10)
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(conns))
+}
+
+func BenchmarkFromOriginSharedClient(b *testing.B) {
+	origin, conns := countingOrigin(b)
+	defer origin.Close()
+	q := originQuery(b, origin)
+	client := testClient(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := q.fromOrigin(context.Background(), client, http.Header{}, 0, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+}
+
+// BenchmarkFromOriginClientPerRequest воспроизводит прежнее поведение: новый
+// клиент и транспорт на каждый запрос.
+func BenchmarkFromOriginClientPerRequest(b *testing.B) {
+	origin, conns := countingOrigin(b)
+	defer origin.Close()
+	q := originQuery(b, origin)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := testClient(b)
+		if _, _, err := q.fromOrigin(context.Background(), client, http.Header{}, 0, nil); err != nil {
+			b.Fatal(err)
+		}
+		client.CloseIdleConnections()
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+}
@@ -0,0 +1,86 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+)
+
+// flightGroup объединяет одновременные промахи кэша по одному ключу: fn
+// выполняется один раз, остальные запросы ждут его результата. Каждый ждущий
+// может уйти по своему контексту; fn отменяется, только когда ушли все.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[cache.Key]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	pic     []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do возвращает результат fn для ключа key и признак того, что результат
+// получен чужим вызовом.
+func (g *flightGroup) do(ctx context.Context, key cache.Key, fn func(ctx context.Context) ([]byte, error)) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = map[cache.Key]*flight{}
+	}
+	f, shared := g.flights[key]
+	if !shared {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			defer func() {
+				// Паника в fn не должна ронять процесс: net/http здесь ее уже
+				// не перехватит. Ждущие получат ошибку 500.
+				if r := recover(); r != nil {
+					f.pic, f.err = nil, &statusError{http.StatusInternalServerError, fmt.Errorf("panic while producing pic: %v", r)}
+				}
+				cancel()
+				g.forget(key, f)
+				close(f.done)
+			}()
+			f.pic, f.err = fn(fctx)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.pic, shared, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			g.forgetLocked(key, f)
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// forget убирает завершенный вызов, чтобы следующий промах начал новый.
+func (g *flightGroup) forget(key cache.Key, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.forgetLocked(key, f)
+}
+
+func (g *flightGroup) forgetLocked(key cache.Key, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
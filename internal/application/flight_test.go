@@ -0,0 +1,191 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+
+func newTestCache(t *testing.T) cache.Cache {
+	dir, err := ioutil.TempDir("", "cache.")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c, err := cache.NewCache(10, 0, dir)
+	require.NoError(t, err)
+	return c
+}
+
+// testPic - JPEG 64x64, который отдают тестовые origin'ы.
+func testPic(t *testing.T) []byte {
+	var b bytes.Buffer
+	require.NoError(t, jpeg.Encode(&b, image.NewRGBA(image.Rect(0, 0, 64, 64)), nil))
+	return b.Bytes()
+}
+
+// testOrigin поднимает origin с обработчиком fn и возвращает его вместе со
+// счетчиком запросов к нему.
+func testOrigin(t *testing.T, fn http.HandlerFunc) (*httptest.Server, *int64) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		fn(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// newTestHandler создает handler над кэшем c с настройками conf, в которых
+// разрешены частные адреса тестовых origin'ов. При s == nil задачи выполняет
+// один воркер.
+func newTestHandler(t *testing.T, conf config.Config, c cache.Cache, s *scheduler) http.Handler {
+	conf.Origin.AllowPrivate = true
+	p, err := newOriginPolicy(conf)
+	require.NoError(t, err)
+	hp, err := newHeaderPolicy(conf)
+	require.NoError(t, err)
+	if s == nil {
+		s = newScheduler(1, 1, time.Second)
+	}
+	return handler(c, conf, nopLogger{}, p, hp, newOriginClient(conf, p), s)
+}
+
+func TestFlightGroup(t *testing.T) {
+	var (
+		g     flightGroup
+		calls int64
+	)
+	release := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return []byte("pic"), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	shared := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			results[i], shared[i], err = g.do(context.Background(), "key", fn)
+			require.NoError(t, err)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Ждущий с истекшим контекстом уходит, не мешая остальным.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, wasShared, err := g.do(ctx, "key", fn)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, wasShared)
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls))
+	var leaders int
+	for i := range results {
+		require.Equal(t, []byte("pic"), results[i])
+		if !shared[i] {
+			leaders++
+		}
+	}
+	require.Equal(t, 1, leaders)
+
+	// Следующий промах после завершения запускает fn заново.
+	_, _, err = g.do(context.Background(), "key", func(ctx context.Context) ([]byte, error) { return nil, nil })
+	require.NoError(t, err)
+}
+
+func TestFlightGroupAllWaitersGone(t *testing.T) {
+	var g flightGroup
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, _, err := g.do(ctx, "key", func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	require.Equal(t, context.Canceled, err)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("work must be cancelled when nobody waits for it")
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	_, _, err := g.do(context.Background(), "key", func(ctx context.Context) ([]byte, error) {
+		var m map[string]int
+		m["x"]++
+		return nil, nil
+	})
+	var sErr *statusError
+	require.True(t, errors.As(err, &sErr), err)
+	require.Equal(t, http.StatusInternalServerError, sErr.status)
+
+	// Ключ освобожден, следующий вызов выполняется заново.
+	pic, _, err := g.do(context.Background(), "key", func(ctx context.Context) ([]byte, error) { return []byte("pic"), nil })
+	require.NoError(t, err)
+	require.Equal(t, []byte("pic"), pic)
+}
+
+func TestHandlerCoalescing(t *testing.T) {
+	pic := testPic(t)
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write(pic)
+	})
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, newTestCache(t), newScheduler(2, 20, time.Second))
+
+	path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg")
+	var wg sync.WaitGroup
+	bodies := make([][]byte, 20)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			bodies[i] = w.Body.Bytes()
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(hits))
+	for _, b := range bodies {
+		require.Equal(t, bodies[0], b)
+	}
+}
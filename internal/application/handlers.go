@@ -2,8 +2,11 @@ package application
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/tiburon-777/OTUS_Project/internal/cache"
@@ -12,61 +15,218 @@ import (
 	"github.com/tiburon-777/OTUS_Project/internal/logger"
 )
 
-func handler(c cache.Cache, conf config.Config, log logger.Interface) http.Handler {
+// statusError - ошибка обработки запроса вместе с HTTP-статусом ответа.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func (e *statusError) Unwrap() error { return e.err }
+
+func handler(c cache.Cache, conf config.Config, log logger.Interface, origin *originPolicy, headers *headerPolicy, client *http.Client, sched *scheduler) http.Handler {
+	var flights flightGroup
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, cansel := context.WithCancel(context.Background())
-		defer cansel()
-		q, err := buildQuery(r.URL)
+		q, err := buildQuery(r.URL, conf)
 		if err != nil {
 			wErr := fmt.Errorf("can't parse query:\n %w", err)
 			log.Warnf(wErr.Error())
 			http.Error(w, wErr.Error(), http.StatusBadRequest)
 			return
 		}
-		b, ok1, err := c.Get(cache.Key(q.id()))
-		if err != nil {
-			wErr := fmt.Errorf("can't get pic from cache:\n %w", err)
-			log.Errorf(wErr.Error())
-			http.Error(w, wErr.Error(), http.StatusInternalServerError)
+		if err := origin.checkHost(q.URL.Hostname()); err != nil {
+			log.Warnf(err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-		pic, ok2 := b.([]byte)
-		if ok1 && ok2 {
+		// Accept влияет на результат, только если формат не задан явно.
+		if q.Format == "" {
+			w.Header().Set("Vary", "Accept")
+			if acceptsWebP(r.Header.Get("Accept")) {
+				q.Prefer = converter.FormatWebP
+			}
+		}
+		key := cache.Key(q.id())
+		// Недоступный кэш не мешает отдавать картинки: ошибка считается промахом.
+		b, ok1, err := c.Get(key)
+		if err != nil {
+			log.Errorf("can't get pic from cache, treating as miss:\n %s", err)
+			b, ok1 = nil, false
+		}
+		if !ok1 && q.Prefer != "" {
+			// Картинка, на формат которой Prefer не повлиял, хранится одна на всех
+			// клиентов - под ключом без Prefer.
+			if v, ok, err := c.Get(q.plainKey()); err == nil && ok {
+				if e, ok := v.(cache.Entry); ok && e.AnyAccept {
+					b, ok1 = e, true
+				}
+			}
+		}
+		now := time.Now()
+		if pic, ok := fresh(b, now); ok1 && ok {
 			log.Infof("getting pic from cache")
 			w.Header().Add("X-From-Appcache", "true")
+			w.Header().Set("X-Cache", "HIT")
 			_, _ = w.Write(pic)
 			return
 		}
-		pic, res, err := q.fromOrigin(ctx, r.Header, time.Duration(conf.Query.Timeout)*time.Second)
-		if err != nil {
-			wErr := fmt.Errorf("can't get pic from origin:\n %w", err)
-			log.Warnf(wErr.Error())
-			http.Error(w, wErr.Error(), http.StatusBadGateway)
-			return
+		var stale *cache.Entry
+		if e, ok := b.(cache.Entry); ok1 && ok {
+			stale = &e
 		}
-		if res.StatusCode != 200 {
-			log.Infof("Pic not found in origin or have problem with upstream. Response status:", res.Status)
-			http.Error(w, "Pic not found in origin or have problem with upstream", res.StatusCode)
-			return
+		// Одновременные промахи по одному ключу загружаются и конвертируются один
+		// раз, с заголовками первого из запросов.
+		h := headers.build(q.URL.Hostname(), r)
+		refresh := func(ctx context.Context) ([]byte, error) {
+			return preview(ctx, q, c, conf, log, client, sched, h, stale)
 		}
-		pic, err = converter.SelectType(q.Width, q.Height, pic)
-		if err != nil {
-			wErr := fmt.Errorf("can't convert pic:\n %w", err)
-			log.Errorf(wErr.Error())
-			http.Error(w, wErr.Error(), http.StatusInternalServerError)
+		if stale != nil && stale.Usable(now, stale.StaleWhileRevalidate) {
+			log.Infof("getting stale pic from cache, refreshing it in background")
+			go func() {
+				if _, _, err := flights.do(context.Background(), key, refresh); err != nil {
+					log.Warnf("can't refresh stale pic:\n %s", err)
+				}
+			}()
+			writeStale(w, stale.Value)
 			return
 		}
-		_, err = c.Set(cache.Key(q.id()), pic)
+		pic, shared, err := flights.do(r.Context(), key, refresh)
+		if shared {
+			log.Infof("pic was produced by concurrent request")
+		}
 		if err != nil {
-			wErr := fmt.Errorf("can't add pic to cache:\n %w", err)
-			log.Errorf(wErr.Error())
-			http.Error(w, wErr.Error(), http.StatusInternalServerError)
+			status := http.StatusInternalServerError
+			var sErr *statusError
+			if errors.As(err, &sErr) {
+				status = sErr.status
+			}
+			if status >= 500 && stale != nil && stale.Usable(time.Now(), stale.StaleIfError) {
+				log.Warnf("getting stale pic from cache because of error:\n %s", err)
+				writeStale(w, stale.Value)
+				return
+			}
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter(sched)))
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
+		w.Header().Set("X-Cache", "MISS")
 		_, _ = w.Write(pic)
 	})
 }
 
+// writeStale отдает просроченную картинку из кэша.
+func writeStale(w http.ResponseWriter, pic []byte) {
+	w.Header().Add("X-From-Appcache", "true")
+	w.Header().Set("X-Cache", "STALE")
+	_, _ = w.Write(pic)
+}
+
+// preview загружает картинку с origin'а, конвертирует и кладет в кэш. Если
+// передана просроченная запись stale с валидаторами, запрос делается условным
+// и, если оригинал не изменился (304), продлевается срок ее жизни без
+// повторной конвертации.
+func preview(ctx context.Context, q Query, c cache.Cache, conf config.Config, log logger.Interface, client *http.Client, sched *scheduler, h http.Header, stale *cache.Entry) ([]byte, error) {
+	var validators *cache.Meta
+	if stale != nil && (stale.ETag != "" || stale.LastModified != "") {
+		validators = &stale.Meta
+	}
+	pic, res, err := q.fromOrigin(ctx, client, h, conf.Query.MaxBodySize, validators)
+	if err != nil {
+		wErr := fmt.Errorf("can't get pic from origin:\n %w", err)
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, ErrOriginTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, ErrForbiddenOrigin):
+			status = http.StatusForbidden
+		}
+		log.Warnf(wErr.Error())
+		return nil, &statusError{status, wErr}
+	}
+	if res.StatusCode == http.StatusNotModified && validators != nil {
+		log.Infof("pic in origin is not modified, refreshing cache entry")
+		if !storable(res.Header) {
+			return stale.Value, nil
+		}
+		e := cache.Entry{Value: stale.Value, Meta: refreshMeta(stale.Meta, res.Header, time.Now(), conf)}
+		key := cache.Key(q.id())
+		if stale.AnyAccept {
+			e.AnyAccept = true
+			key = q.plainKey()
+		}
+		if _, err = c.Set(key, e); err != nil {
+			log.Errorf("can't refresh pic in cache:\n %s", err)
+		}
+		return stale.Value, nil
+	}
+	if res.StatusCode != 200 {
+		log.Infof("Pic not found in origin or have problem with upstream. Response status:", res.Status)
+		return nil, &statusError{res.StatusCode, errors.New("Pic not found in origin or have problem with upstream")}
+	}
+	if sErr := sched.run(ctx, func() { pic, err = converter.SelectType(q.Options, pic) }); sErr != nil {
+		wErr := fmt.Errorf("can't convert pic:\n %w", sErr)
+		log.Warnf(wErr.Error())
+		return nil, &statusError{http.StatusServiceUnavailable, wErr}
+	}
+	if err != nil {
+		wErr := fmt.Errorf("can't convert pic:\n %w", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, converter.ErrTooManyFrames) || errors.Is(err, converter.ErrTooManyPixels) {
+			status = http.StatusUnprocessableEntity
+		}
+		log.Errorf(wErr.Error())
+		return nil, &statusError{status, wErr}
+	}
+	if !storable(res.Header) {
+		return pic, nil
+	}
+	e := cache.Entry{Value: pic, Meta: entryMeta(res.Header, time.Now(), conf)}
+	key := cache.Key(q.id())
+	if q.Prefer == converter.FormatWebP && http.DetectContentType(pic) != "image/webp" {
+		e.AnyAccept = true
+		key = q.plainKey()
+	}
+	// Картинка отдается, даже если ее не удалось сохранить в кэш.
+	if _, err = c.Set(key, e); errors.Is(err, cache.ErrTooLarge) {
+		log.Warnf("pic is not cached:\n %s", err)
+	} else if err != nil {
+		log.Errorf("can't add pic to cache:\n %s", err)
+	}
+	return pic, nil
+}
+
+// fresh возвращает картинку из записи кэша, если срок ее жизни не истек.
+// Записи без метаданных считаются свежими.
+func fresh(v interface{}, now time.Time) ([]byte, bool) {
+	switch e := v.(type) {
+	case []byte:
+		return e, true
+	case cache.Entry:
+		return e.Value, e.Fresh(now)
+	}
+	return nil, false
+}
+
+// retryAfter - через сколько секунд клиенту стоит повторить запрос при перегрузке.
+func retryAfter(s *scheduler) int {
+	if sec := int(s.timeout / time.Second); sec > 0 {
+		return sec
+	}
+	return 1
+}
+
+// metricsHandler отдает метрики expvar по пути /debug/vars. Метрики (в том
+// числе cmdline и memstats) публикуются только на отдельном адресе
+// Server.AdminAddress, а не на основном.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
 func loggingMiddleware(next http.Handler, l logger.Interface) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
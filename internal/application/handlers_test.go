@@ -0,0 +1,46 @@
+package application
+
+import (
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func TestHandlerCacheDown(t *testing.T) {
+	pic := testPic(t)
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pic)
+	})
+
+	// Redis падает после запуска сервиса.
+	m, err := miniredis.Run()
+	require.NoError(t, err)
+	c, err := cache.New(cache.Options{Backend: "redis", RedisAddr: m.Addr()})
+	require.NoError(t, err)
+	defer c.Close()
+	m.Close()
+
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, c, nil)
+
+	// Картинки отдаются с origin'а, как при промахе.
+	path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg")
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+		_, err = jpeg.Decode(w.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(i), atomic.LoadInt64(hits))
+	}
+}
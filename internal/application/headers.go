@@ -0,0 +1,129 @@
+package application
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+// hopHeaders относятся к соединению с клиентом и не пересылаются никогда.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+}
+
+// headerRule описывает, какие заголовки клиента уходят на origin.
+type headerRule struct {
+	forward   map[string]bool // "*" - все заголовки
+	strip     map[string]bool
+	set       map[string]string
+	userAgent string
+}
+
+// headerPolicy собирает заголовки запроса к origin'у: пересылает разрешенные
+// заголовки клиента, убирает запрещенные, добавляет фиксированные,
+// User-Agent и X-Forwarded-For. Для хостов из Origins правило уточняется:
+// Forward заменяется, Strip и Set дополняются, UserAgent заменяется, если задан.
+type headerPolicy struct {
+	base         headerRule
+	hosts        []string
+	rules        []headerRule
+	forwardedFor bool
+}
+
+func newHeaderPolicy(conf config.Config) (*headerPolicy, error) {
+	h := conf.Headers
+	p := &headerPolicy{
+		base:         headerRule{forward: headerSet(h.Forward), strip: headerSet(h.Strip), set: canonicalMap(h.Set), userAgent: h.UserAgent},
+		forwardedFor: h.ForwardedFor,
+	}
+	for _, o := range h.Origins {
+		host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(o.Host)), ".")
+		if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") && host != "*" {
+			return nil, fmt.Errorf("not valid origin host pattern %q", o.Host)
+		}
+		r := headerRule{forward: p.base.forward, strip: headerSet(h.Strip, o.Strip...), set: canonicalMap(h.Set), userAgent: h.UserAgent}
+		if o.Forward != nil {
+			r.forward = headerSet(o.Forward)
+		}
+		for k, v := range canonicalMap(o.Set) {
+			r.set[k] = v
+		}
+		if o.UserAgent != "" {
+			r.userAgent = o.UserAgent
+		}
+		p.hosts = append(p.hosts, host)
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// rule возвращает правило для хоста: первое подходящее из Origins или общее.
+func (p *headerPolicy) rule(host string) headerRule {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for i, h := range p.hosts {
+		if matchHost([]string{h}, host) {
+			return p.rules[i]
+		}
+	}
+	return p.base
+}
+
+// build возвращает заголовки запроса к origin'у host для запроса клиента r.
+func (p *headerPolicy) build(host string, r *http.Request) http.Header {
+	rule := p.rule(host)
+	res := http.Header{}
+	for k, v := range r.Header {
+		k = http.CanonicalHeaderKey(k)
+		if hopHeaders[k] || rule.strip[k] || !(rule.forward["*"] || rule.forward[k]) {
+			continue
+		}
+		res[k] = append([]string(nil), v...)
+	}
+	if rule.userAgent != "" {
+		res.Set("User-Agent", rule.userAgent)
+	}
+	if p.forwardedFor {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			res.Set("X-Forwarded-For", ip)
+		}
+	}
+	for k, v := range rule.set {
+		res.Set(k, v)
+	}
+	return res
+}
+
+func headerSet(names []string, more ...string) map[string]bool {
+	res := make(map[string]bool, len(names)+len(more))
+	for _, n := range append(append([]string(nil), names...), more...) {
+		if n == "*" {
+			res[n] = true
+			continue
+		}
+		res[http.CanonicalHeaderKey(n)] = true
+	}
+	return res
+}
+
+func canonicalMap(m map[string]string) map[string]string {
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		res[http.CanonicalHeaderKey(k)] = v
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package application
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Headers.Forward = []string{"accept-language", "Cookie"}
+	conf.Headers.Set = map[string]string{"x-service": "previewer"}
+	conf.Headers.Origins = append(conf.Headers.Origins, struct {
+		Host      string
+		Forward   []string
+		Strip     []string
+		Set       map[string]string
+		UserAgent string
+	}{Host: "*.cdn.net", Forward: []string{"*"}, Strip: []string{"Cookie"}, Set: map[string]string{"Authorization": "Bearer cdn"}, UserAgent: "cdn-agent"})
+	p, err := newHeaderPolicy(conf)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/fill/10/10/a.com/x.jpg", nil)
+	r.RemoteAddr = "203.0.113.7:5555"
+	r.Header.Set("Accept-Language", "ru")
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Authorization", "Basic secret")
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Connection", "keep-alive")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	table := []struct {
+		host     string
+		expected http.Header
+		msg      string
+	}{
+		{
+			host: "a.com",
+			expected: http.Header{
+				"Accept-Language": {"ru"},
+				"Cookie":          {"session=1"},
+				"User-Agent":      {"previewer"},
+				"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"},
+				"X-Service":       {"previewer"},
+			},
+			msg: "Default rule",
+		},
+		{
+			host: "img.CDN.net",
+			expected: http.Header{
+				"Accept-Language": {"ru"},
+				"Accept-Encoding": {"gzip"},
+				"Authorization":   {"Bearer cdn"},
+				"User-Agent":      {"cdn-agent"},
+				"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"},
+				"X-Service":       {"previewer"},
+			},
+			msg: "Origin override",
+		},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			require.Equal(t, dat.expected, p.build(dat.host, r))
+		})
+	}
+}
+
+func TestHeaderPolicyDefaults(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Headers.ForwardedFor = false
+	p, err := newHeaderPolicy(conf)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/fill/10/10/a.com/x.jpg", nil)
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Authorization", "Basic secret")
+	require.Equal(t, http.Header{"User-Agent": {"previewer"}}, p.build("a.com", r))
+}
+
+func TestHeaderPolicyNotValidHost(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Headers.Origins = append(conf.Headers.Origins, struct {
+		Host      string
+		Forward   []string
+		Strip     []string
+		Set       map[string]string
+		UserAgent string
+	}{Host: "a.*.com"})
+	_, err := newHeaderPolicy(conf)
+	require.Error(t, err)
+}
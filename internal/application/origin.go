@@ -0,0 +1,194 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+var ErrForbiddenOrigin = errors.New("origin is forbidden")
+
+// privateNets - адреса, недоступные по умолчанию: loopback, частные сети,
+// link-local (в том числе метаданные облаков 169.254.169.254) и служебные диапазоны.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// originPolicy решает, к каким исходным серверам можно обращаться.
+//
+// Элементы списков Allow и Deny - домены ("example.com"), маски поддоменов
+// ("*.example.com", "*" - любой), IP-адреса и CIDR. Deny проверяется первым.
+// Непустой Allow пропускает только совпавшие домены и адреса из его CIDR, в
+// том числе адреса, в которые разрешилось имя, не совпавшее с доменами.
+// Частные адреса запрещены, пока не задан AllowPrivate или адрес не входит в
+// CIDR из Allow. Адреса проверяются при соединении, после разрешения имени,
+// поэтому DNS rebinding не помогает обойти запрет.
+type originPolicy struct {
+	allowHosts   []string
+	denyHosts    []string
+	allowNets    []*net.IPNet
+	denyNets     []*net.IPNet
+	allowPrivate bool
+}
+
+func newOriginPolicy(conf config.Config) (*originPolicy, error) {
+	p := &originPolicy{allowPrivate: conf.Origin.AllowPrivate}
+	var err error
+	if p.allowHosts, p.allowNets, err = parseRules(conf.Origin.Allow); err != nil {
+		return nil, fmt.Errorf("not valid allow list:\n %w", err)
+	}
+	if p.denyHosts, p.denyNets, err = parseRules(conf.Origin.Deny); err != nil {
+		return nil, fmt.Errorf("not valid deny list:\n %w", err)
+	}
+	return p, nil
+}
+
+func parseRules(rules []string) ([]string, []*net.IPNet, error) {
+	var (
+		hosts []string
+		nets  []*net.IPNet
+	)
+	for _, r := range rules {
+		r = strings.ToLower(strings.TrimSpace(r))
+		switch {
+		case r == "":
+			continue
+		case strings.Contains(r, "/"):
+			_, n, err := net.ParseCIDR(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, n)
+		case net.ParseIP(r) != nil:
+			ip := net.ParseIP(r)
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case r == "*" || !strings.Contains(strings.TrimPrefix(r, "*."), "*"):
+			hosts = append(hosts, strings.TrimSuffix(r, "."))
+		default:
+			return nil, nil, fmt.Errorf("not valid host pattern %q", r)
+		}
+	}
+	return hosts, nets, nil
+}
+
+// checkRedirect не дает клиенту следовать редиректам на запрещенные хосты.
+func (p *originPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return p.checkHost(req.URL.Hostname())
+}
+
+// checkHost проверяет имя хоста из адреса до отправки запроса.
+func (p *originPolicy) checkHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		if containsIP(p.denyNets, ip) {
+			return fmt.Errorf("%w: %s is denied", ErrForbiddenOrigin, host)
+		}
+		if (len(p.allowHosts) > 0 || len(p.allowNets) > 0) && !containsIP(p.allowNets, ip) && !matchHost(p.allowHosts, "*") {
+			return fmt.Errorf("%w: %s is not allowed", ErrForbiddenOrigin, host)
+		}
+		return nil
+	}
+	if matchHost(p.denyHosts, host) {
+		return fmt.Errorf("%w: %s is denied", ErrForbiddenOrigin, host)
+	}
+	// При CIDR в Allow имя может разрешиться в разрешенный адрес: это
+	// проверяется при соединении.
+	if len(p.allowHosts) > 0 && len(p.allowNets) == 0 && !matchHost(p.allowHosts, host) {
+		return fmt.Errorf("%w: %s is not allowed", ErrForbiddenOrigin, host)
+	}
+	return nil
+}
+
+// hostAllowed сообщает, пропускает ли Allow хост по имени, без учета адреса.
+func (p *originPolicy) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return len(p.allowHosts) == 0 && len(p.allowNets) == 0 || matchHost(p.allowHosts, host)
+}
+
+// checkIP проверяет адрес, с которым устанавливается соединение. hostAllowed -
+// пропущено ли имя хоста списком Allow; иначе адрес должен входить в его CIDR.
+func (p *originPolicy) checkIP(ip net.IP, hostAllowed bool) error {
+	if containsIP(p.denyNets, ip) {
+		return fmt.Errorf("%w: %s is denied", ErrForbiddenOrigin, ip)
+	}
+	if !hostAllowed && !containsIP(p.allowNets, ip) {
+		return fmt.Errorf("%w: %s is not allowed", ErrForbiddenOrigin, ip)
+	}
+	if !p.allowPrivate && containsIP(privateNets, ip) && !containsIP(p.allowNets, ip) {
+		return fmt.Errorf("%w: %s is a private address", ErrForbiddenOrigin, ip)
+	}
+	return nil
+}
+
+// dialContext оборачивает d так, что каждый адрес, к которому он подключается,
+// проверяется checkIP с учетом имени хоста, переданного для соединения.
+func (p *originPolicy) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		allowed := p.hostAllowed(host)
+		dialer := *d
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			h, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(h)
+			if ip == nil {
+				return fmt.Errorf("%w: can't parse address %q", ErrForbiddenOrigin, address)
+			}
+			return p.checkIP(ip, allowed)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		switch {
+		case p == "*", p == host:
+			return true
+		case strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
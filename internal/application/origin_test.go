@@ -0,0 +1,157 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func policy(t *testing.T, allow, deny []string, allowPrivate bool) *originPolicy {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Origin.Allow = allow
+	conf.Origin.Deny = deny
+	conf.Origin.AllowPrivate = allowPrivate
+	p, err := newOriginPolicy(conf)
+	require.NoError(t, err)
+	return p
+}
+
+func TestOriginPolicyHost(t *testing.T) {
+	table := []struct {
+		allow, deny []string
+		host        string
+		err         bool
+		msg         string
+	}{
+		{host: "example.com", msg: "Empty lists"},
+		{deny: []string{"example.com"}, host: "EXAMPLE.com.", err: true, msg: "Denied host"},
+		{deny: []string{"*.example.com"}, host: "a.b.example.com", err: true, msg: "Denied subdomain"},
+		{deny: []string{"*.example.com"}, host: "example.com", msg: "Wildcard doesn't match domain itself"},
+		{deny: []string{"*.example.com"}, host: "badexample.com", msg: "Wildcard matches whole labels"},
+		{allow: []string{"*.cdn.net"}, host: "img.cdn.net", msg: "Allowed subdomain"},
+		{allow: []string{"*.cdn.net"}, host: "evil.com", err: true, msg: "Not in allow list"},
+		{allow: []string{"*.cdn.net"}, host: "203.0.113.5", err: true, msg: "IP literal not in allow list"},
+		{allow: []string{"*.cdn.net", "203.0.113.0/24"}, host: "203.0.113.5", msg: "IP literal in allowed CIDR"},
+		{allow: []string{"203.0.113.0/24"}, host: "203.0.113.6", msg: "IP literal in CIDR-only allow list"},
+		{allow: []string{"203.0.113.0/24"}, host: "8.8.8.8", err: true, msg: "IP literal outside CIDR-only allow list"},
+		{allow: []string{"*"}, deny: []string{"evil.com"}, host: "evil.com", err: true, msg: "Deny wins"},
+		{deny: []string{"10.0.0.0/8"}, host: "10.1.2.3", err: true, msg: "IP literal in denied CIDR"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			err := policy(t, dat.allow, dat.deny, false).checkHost(dat.host)
+			require.Equal(t, dat.err, err != nil, err)
+			if err != nil {
+				require.True(t, errors.Is(err, ErrForbiddenOrigin))
+			}
+		})
+	}
+}
+
+func TestOriginPolicyIP(t *testing.T) {
+	table := []struct {
+		allow, deny  []string
+		allowPrivate bool
+		host         string
+		ip           string
+		err          bool
+		msg          string
+	}{
+		{ip: "93.184.216.34", msg: "Public address"},
+		{ip: "127.0.0.1", err: true, msg: "Loopback"},
+		{ip: "::1", err: true, msg: "IPv6 loopback"},
+		{ip: "169.254.169.254", err: true, msg: "Cloud metadata"},
+		{ip: "192.168.1.10", err: true, msg: "Private network"},
+		{ip: "::ffff:10.0.0.1", err: true, msg: "IPv4-mapped private"},
+		{ip: "fd00::1", err: true, msg: "IPv6 unique local"},
+		{ip: "0.0.0.0", err: true, msg: "Unspecified"},
+		{allowPrivate: true, ip: "10.0.0.1", msg: "Private allowed by config"},
+		{allow: []string{"10.1.0.0/16"}, ip: "10.1.2.3", msg: "Private allowed by CIDR"},
+		{allow: []string{"10.1.0.0/16"}, ip: "10.2.0.1", err: true, msg: "Other private network"},
+		{deny: []string{"93.184.216.0/24"}, ip: "93.184.216.34", err: true, msg: "Denied public network"},
+		{allow: []string{"203.0.113.0/24"}, host: "evil.example", ip: "8.8.8.8", err: true, msg: "Name resolved outside CIDR-only allow list"},
+		{allow: []string{"203.0.113.0/24"}, host: "img.example", ip: "203.0.113.7", msg: "Name resolved into allowed CIDR"},
+		{allow: []string{"203.0.113.0/24", "*.cdn.net"}, host: "img.cdn.net", ip: "8.8.8.8", msg: "Allowed name resolved outside CIDR"},
+		{allow: []string{"*.cdn.net"}, host: "img.cdn.net", ip: "127.0.0.1", err: true, msg: "Allowed name resolved to loopback"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			p := policy(t, dat.allow, dat.deny, dat.allowPrivate)
+			host := dat.host
+			if host == "" {
+				host = dat.ip
+			}
+			err := p.checkIP(net.ParseIP(dat.ip), p.hostAllowed(host))
+			require.Equal(t, dat.err, err != nil, err)
+		})
+	}
+}
+
+func TestOriginPolicyRules(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Origin.Allow = []string{"10.0.0.0/33"}
+	_, err := newOriginPolicy(conf)
+	require.Error(t, err)
+	conf.Origin.Allow = []string{"a.*.com"}
+	_, err = newOriginPolicy(conf)
+	require.Error(t, err)
+}
+
+func TestOriginPolicyFetch(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("pic"))
+	}))
+	defer origin.Close()
+	_, port, err := net.SplitHostPort(origin.Listener.Addr().String())
+	require.NoError(t, err)
+	local := "http://localhost:" + port + "/pic.jpg"
+	var conf config.Config
+	conf.SetDefault()
+
+	table := []struct {
+		allow, deny  []string
+		allowPrivate bool
+		url          string
+		err          bool
+		msg          string
+	}{
+		{url: origin.URL + "/pic.jpg", err: true, msg: "Loopback is blocked by default"},
+		{allowPrivate: true, url: origin.URL + "/pic.jpg", msg: "Loopback allowed by config"},
+		{allow: []string{"127.0.0.0/8"}, url: origin.URL + "/pic.jpg", msg: "Loopback allowed by CIDR"},
+		{allow: []string{"localhost"}, url: local, err: true, msg: "Allowed name resolving to loopback"},
+		{allow: []string{"203.0.113.0/24"}, allowPrivate: true, url: local, err: true, msg: "Name resolving outside CIDR-only allow list"},
+		{allow: []string{"127.0.0.0/8"}, url: local, msg: "Name resolving into allowed CIDR"},
+		{allowPrivate: true, deny: []string{"localhost"}, url: origin.URL + "/redirect?to=" + url.QueryEscape(local), err: true, msg: "Redirect to denied host"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			p := policy(t, dat.allow, dat.deny, dat.allowPrivate)
+			u, err := url.Parse(dat.url)
+			require.NoError(t, err)
+			q := Query{URL: u}
+			body, _, err := q.fromOrigin(context.Background(), newOriginClient(conf, p), http.Header{}, 0, nil)
+			if dat.err {
+				require.True(t, errors.Is(err, ErrForbiddenOrigin), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte("pic"), body)
+		})
+	}
+}
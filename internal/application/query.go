@@ -2,63 +2,302 @@ package application
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
+
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+	"github.com/tiburon-777/OTUS_Project/internal/converter"
 )
 
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+var ErrOriginTooLarge = errors.New("origin response is too large")
+
 type Query struct {
-	Width  int
-	Height int
-	URL    *url.URL
+	converter.Options
+	URL *url.URL
 }
 
-func buildQuery(u *url.URL) (q Query, err error) {
-	t := strings.Split(u.Path, "/")
-	if len(t) < 5 {
+func buildQuery(u *url.URL, conf config.Config) (q Query, err error) {
+	t := strings.Split(u.EscapedPath(), "/")
+	if len(t) < 2 {
+		return Query{}, errors.New("need more params")
+	}
+	q.Mode = converter.Mode(t[1])
+	var dims []*int
+	var names []string
+	switch q.Mode {
+	case converter.ModeFill, converter.ModeFit, converter.ModeFitIn, converter.ModeStretch:
+		dims, names = []*int{&q.Width, &q.Height}, []string{"width", "height"}
+	case converter.ModeCrop:
+		dims, names = []*int{&q.X, &q.Y, &q.Width, &q.Height}, []string{"x", "y", "width", "height"}
+	default:
+		return Query{}, fmt.Errorf("unknown mode %q", t[1])
+	}
+	if len(t) < len(dims)+3 {
 		return Query{}, errors.New("need more params")
 	}
-	q.Width, err = strconv.Atoi(t[2])
+	for i, d := range dims {
+		*d, err = strconv.Atoi(t[i+2])
+		if err != nil || *d < 0 {
+			return Query{}, fmt.Errorf("%s must be a non-negative integer", names[i])
+		}
+	}
+	if err = q.checkSize(conf.Converter.MaxSize, conf.Converter.MaxPixels); err != nil {
+		return Query{}, err
+	}
+	if q.Mode == converter.ModeFill {
+		q.Gravity = converter.GravityCenter
+	}
+	q.Background, err = converter.ParseColor(conf.Converter.Background)
 	if err != nil {
-		return Query{}, errors.New("width must be an integer")
+		return Query{}, fmt.Errorf("not valid default background:\n %w", err)
 	}
-	q.Height, err = strconv.Atoi(t[3])
+	q.Quality = conf.Converter.DefaultQuality
+	q.MaxFrames = conf.Converter.MaxFrames
+	q.KeepMeta = conf.Converter.KeepMetadata
+	q.MaxPixels = conf.Converter.MaxPixels
+	rest, err := q.parseOptions(t[len(dims)+2:], conf)
 	if err != nil {
-		return Query{}, errors.New("height must be an integer")
+		return Query{}, err
+	}
+	if len(rest) == 0 {
+		return Query{}, errors.New("need more params")
 	}
-	tn := "http://" + strings.Join(t[4:], "/")
-	q.URL, err = q.URL.Parse(tn)
+	q.URL, err = originURL(rest, u.RawQuery)
 	if err != nil {
-		return Query{}, errors.New("not valid url")
+		return Query{}, err
 	}
 	return q, nil
 }
 
+// checkSize ограничивает размер результата: при изменении размера - maxSize по
+// каждой стороне и maxPixels по площади, при вырезании - размером исходной
+// картинки, который станет известен позже, поэтому здесь проверяется только
+// переполнение углов.
+func (q Query) checkSize(maxSize, maxPixels int) error {
+	if q.Mode == converter.ModeCrop {
+		if q.X > math.MaxInt32-q.Width || q.Y > math.MaxInt32-q.Height {
+			return errors.New("crop area is out of range")
+		}
+		return nil
+	}
+	if maxSize > 0 && (q.Width > maxSize || q.Height > maxSize) {
+		return fmt.Errorf("width and height must not exceed %d", maxSize)
+	}
+	if maxPixels > 0 && q.Width > 0 && q.Height > maxPixels/q.Width {
+		return fmt.Errorf("width*height must not exceed %d pixels", maxPixels)
+	}
+	return nil
+}
+
+// options - имена необязательных параметров вида name:value, которые могут стоять
+// между размерами и адресом исходного изображения.
+var options = map[string]bool{"bg": true, "g": true, "format": true, "q": true, "meta": true}
+
+func (q *Query) parseOptions(segments []string, conf config.Config) ([]string, error) {
+	for ; len(segments) > 0; segments = segments[1:] {
+		kv := strings.SplitN(segments[0], ":", 2)
+		if len(kv) != 2 || !options[kv[0]] {
+			break
+		}
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("not valid %s option", kv[0])
+		}
+		switch kv[0] {
+		case "bg":
+			if q.Mode != converter.ModeFitIn {
+				return nil, errors.New("bg option is supported by fit-in mode only")
+			}
+			if q.Background, err = converter.ParseColor(value); err != nil {
+				return nil, err
+			}
+		case "g":
+			if q.Mode != converter.ModeFill {
+				return nil, errors.New("g option is supported by fill mode only")
+			}
+			if q.Gravity, err = converter.ParseGravity(value); err != nil {
+				return nil, err
+			}
+		case "format":
+			if q.Format, err = converter.ParseFormat(value); err != nil {
+				return nil, err
+			}
+		case "q":
+			min, max := conf.Converter.MinQuality, conf.Converter.MaxQuality
+			if q.Quality, err = strconv.Atoi(value); err != nil || q.Quality < min || q.Quality > max {
+				return nil, fmt.Errorf("quality must be an integer between %d and %d", min, max)
+			}
+		case "meta":
+			switch value {
+			case "keep":
+				q.KeepMeta = true
+			case "strip":
+				q.KeepMeta = false
+			default:
+				return nil, fmt.Errorf("meta must be keep or strip, got %q", value)
+			}
+		}
+	}
+	return segments, nil
+}
+
+// originURL собирает адрес исходного изображения из оставшихся (экранированных) сегментов пути.
+// Поддерживаются формы:
+//
+//	host[:port]/path                  - схема http по умолчанию;
+//	http/host/path, https/host/path   - схема отдельным сегментом;
+//	https://host/path                 - схема в виде префикса URL;
+//	https%3A%2F%2Fhost%2Fpath%3Fa%3Db  - весь URL одним экранированным сегментом.
+//
+// Query string запроса к сервису целиком передается исходному серверу.
+func originURL(segments []string, rawQuery string) (*url.URL, error) {
+	scheme := "http"
+	switch {
+	case isEscapedURL(segments[0]):
+		s, err := url.PathUnescape(strings.Join(segments, "/"))
+		if err != nil {
+			return nil, errors.New("not valid url")
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, errors.New("not valid url")
+		}
+		if rawQuery != "" {
+			if u.RawQuery != "" {
+				u.RawQuery += "&"
+			}
+			u.RawQuery += rawQuery
+		}
+		return checkOrigin(u)
+	case len(segments) > 2 && (segments[0] == "http:" || segments[0] == "https:") && segments[1] == "":
+		scheme = strings.TrimSuffix(segments[0], ":")
+		segments = segments[2:]
+	case len(segments) > 1 && (segments[0] == "http" || segments[0] == "https"):
+		scheme = segments[0]
+		segments = segments[1:]
+	}
+	u, err := url.Parse(scheme + "://" + strings.Join(segments, "/"))
+	if err != nil {
+		return nil, errors.New("not valid url")
+	}
+	u.RawQuery = rawQuery
+	return checkOrigin(u)
+}
+
+func isEscapedURL(segment string) bool {
+	s, err := url.PathUnescape(segment)
+	return err == nil && strings.Contains(s, "://")
+}
+
+func checkOrigin(u *url.URL) (*url.URL, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("only http and https origins are supported")
+	}
+	if u.Host == "" {
+		return nil, errors.New("origin host is empty")
+	}
+	// Учетные данные не входят в ключ кэша: картинку, загруженную с ними, иначе
+	// получили бы анонимные клиенты.
+	if u.User != nil {
+		return nil, errors.New("credentials in origin url are not supported")
+	}
+	return u, nil
+}
+
+// id возвращает ключ кэша - sha256 от канонического представления запроса.
 func (q Query) id() string {
-	return strings.ReplaceAll(strconv.Itoa(q.Width)+"/"+strconv.Itoa(q.Height)+q.URL.Path, "/", "_")
+	sum := sha256.Sum256([]byte(q.canonical()))
+	return hex.EncodeToString(sum[:])
 }
 
-func (q Query) fromOrigin(ctx context.Context, headers http.Header, timeout time.Duration) ([]byte, *http.Response, error) {
-	client := &http.Client{Timeout: timeout}
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+q.URL.Host+q.URL.Path, nil)
+// plainKey - ключ кэша того же запроса без предпочтительного формата клиента.
+func (q Query) plainKey() cache.Key {
+	q.Prefer = ""
+	return cache.Key(q.id())
+}
+
+// canonical описывает запрос так, что одинаковые по смыслу запросы дают одинаковую строку,
+// а запросы, отличающиеся origin'ом или любым параметром преобразования, - разные.
+func (q Query) canonical() string {
+	scheme := strings.ToLower(q.URL.Scheme)
+	port := q.URL.Port()
+	if port == defaultPorts[scheme] {
+		port = ""
+	}
+	bg := q.Background
+	return strings.Join([]string{
+		"mode=" + string(q.Mode),
+		"x=" + strconv.Itoa(q.X),
+		"y=" + strconv.Itoa(q.Y),
+		"w=" + strconv.Itoa(q.Width),
+		"h=" + strconv.Itoa(q.Height),
+		"g=" + string(q.Gravity),
+		fmt.Sprintf("bg=%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A),
+		"format=" + string(q.Format),
+		"q=" + strconv.Itoa(q.Quality),
+		"prefer=" + string(q.Prefer),
+		"meta=" + strconv.FormatBool(q.KeepMeta),
+		"scheme=" + scheme,
+		"host=" + strings.ToLower(q.URL.Hostname()),
+		"port=" + port,
+		"path=" + q.URL.EscapedPath(),
+		"query=" + q.URL.RawQuery,
+	}, "\n")
+}
+
+// fromOrigin загружает исходную картинку. Если maxSize > 0, ответы больше
+// maxSize байт (по Content-Length или фактически прочитанным) отвергаются с
+// ErrOriginTooLarge. Если переданы validators, запрос делается условным и
+// origin может ответить 304 без тела.
+func (q Query) fromOrigin(ctx context.Context, client *http.Client, headers http.Header, maxSize int64, validators *cache.Meta) ([]byte, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", q.URL.String(), nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't create request:\n %w", err)
 	}
-	req.Header = headers
-	req.Close = true
+	req.Header = headers.Clone()
+	// Условные заголовки клиента не пересылаются: 304 имеет смысл, только
+	// когда в кэше есть что обновлять.
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		req.Header.Del(k)
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't do request:\n %w", err)
 	}
-	body, err := ioutil.ReadAll(res.Body)
 	defer res.Body.Close()
+	if maxSize > 0 && res.ContentLength > maxSize {
+		return nil, nil, fmt.Errorf("%w: Content-Length %d exceeds %d bytes", ErrOriginTooLarge, res.ContentLength, maxSize)
+	}
+	r := io.Reader(res.Body)
+	if maxSize > 0 {
+		r = io.LimitReader(res.Body, maxSize+1)
+	}
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't read body from response:\n %w", err)
 	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return nil, nil, fmt.Errorf("%w: body exceeds %d bytes", ErrOriginTooLarge, maxSize)
+	}
 	return body, res, nil
 }
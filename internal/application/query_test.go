@@ -1,12 +1,26 @@
 package application
 
 import (
-	"github.com/stretchr/testify/require"
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+	"github.com/tiburon-777/OTUS_Project/internal/converter"
 )
 
 func TestBuildQuery(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
 
 	urlParcer := func(u string) *url.URL {
 		res, _ := url.Parse(u)
@@ -27,6 +41,36 @@ func TestBuildQuery(t *testing.T) {
 		{
 			url: urlParcer("/fill/10/10/pic.jpg"), expWidth: 10, expHeight: 10, expURL: urlParcer("http://pic.jpg"), err: false, msg: "Short URL",
 		},
+		{
+			url: urlParcer("/fill/10/10/domain.me:8080/some/pic.jpg"), expWidth: 10, expHeight: 10, expURL: urlParcer("http://domain.me:8080/some/pic.jpg"), err: false, msg: "Origin with port",
+		},
+		{
+			url: urlParcer("/fill/10/10/domain.me/some/pic.jpg?token=abc&exp=1"), expWidth: 10, expHeight: 10, expURL: urlParcer("http://domain.me/some/pic.jpg?token=abc&exp=1"), err: false, msg: "Origin with query string",
+		},
+		{
+			url: urlParcer("/fill/10/10/https/domain.me:8443/some/pic.jpg?token=abc"), expWidth: 10, expHeight: 10, expURL: urlParcer("https://domain.me:8443/some/pic.jpg?token=abc"), err: false, msg: "Scheme as a segment",
+		},
+		{
+			url: urlParcer("/fill/10/10/http/domain.me/some/pic.jpg"), expWidth: 10, expHeight: 10, expURL: urlParcer("http://domain.me/some/pic.jpg"), err: false, msg: "Explicit http scheme as a segment",
+		},
+		{
+			url: urlParcer("/fill/10/10/https://domain.me/some/pic.jpg"), expWidth: 10, expHeight: 10, expURL: urlParcer("https://domain.me/some/pic.jpg"), err: false, msg: "Scheme as a prefix",
+		},
+		{
+			url: urlParcer("/fill/10/10/https%3A%2F%2Fdomain.me%3A8443%2Fsome%2Fpic.jpg%3Ftoken%3Dabc"), expWidth: 10, expHeight: 10, expURL: urlParcer("https://domain.me:8443/some/pic.jpg?token=abc"), err: false, msg: "Escaped origin URL",
+		},
+		{
+			url: urlParcer("/fill/10/10/https%3A%2F%2Fdomain.me%2Fsome%2Fpic.jpg%3Ftoken%3Dabc?exp=1"), expWidth: 10, expHeight: 10, expURL: urlParcer("https://domain.me/some/pic.jpg?token=abc&exp=1"), err: false, msg: "Escaped origin URL with query string",
+		},
+		{
+			url: urlParcer("/fill/10/10/ftp%3A%2F%2Fdomain.me%2Fsome%2Fpic.jpg"), expWidth: 0, expHeight: 0, expURL: nil, err: true, msg: "Unsupported scheme",
+		},
+		{
+			url: urlParcer("/fill/10/10/user:pass@domain.me/some/pic.jpg"), expWidth: 0, expHeight: 0, expURL: nil, err: true, msg: "Credentials in origin",
+		},
+		{
+			url: urlParcer("/fill/10/10/https%3A%2F%2Fuser%40domain.me%2Fsome%2Fpic.jpg"), expWidth: 0, expHeight: 0, expURL: nil, err: true, msg: "Credentials in escaped origin",
+		},
 		{
 			url: urlParcer("/fill/10"), expWidth: 0, expHeight: 0, expURL: nil, err: true, msg: "Only width",
 		},
@@ -44,7 +88,7 @@ func TestBuildQuery(t *testing.T) {
 	for _, dat := range table {
 		t.Run(dat.msg, func(t *testing.T) {
 			i := false
-			query, err := buildQuery(dat.url)
+			query, err := buildQuery(dat.url, conf)
 			if err != nil {
 				i = true
 			}
@@ -55,3 +99,272 @@ func TestBuildQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildQueryModes(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+	table := []struct {
+		url  string
+		opts converter.Options
+		err  bool
+		msg  string
+	}{
+		{
+			url: "/fill/300/200/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFill, Width: 300, Height: 200, Gravity: converter.GravityCenter, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fill",
+		},
+		{
+			url: "/fill/300/200/g:north/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFill, Width: 300, Height: 200, Gravity: converter.GravityNorth, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fill with gravity",
+		},
+		{
+			url: "/fill/300/200/g:fp:0.3,0.25/domain.me:8080/pic.jpg", opts: converter.Options{Mode: converter.ModeFill, Width: 300, Height: 200, Gravity: "fp:0.3,0.25", Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fill with focal point",
+		},
+		{
+			url: "/fill/300/200/g:smart/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFill, Width: 300, Height: 200, Gravity: converter.GravitySmart, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fill with smart gravity",
+		},
+		{
+			url: "/fill/300/200/g:up/domain.me/pic.jpg", err: true, msg: "Not valid gravity",
+		},
+		{
+			url: "/fit/300/200/g:north/domain.me/pic.jpg", err: true, msg: "Gravity for fit",
+		},
+		{
+			url: "/fit/300/200/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFit, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fit",
+		},
+		{
+			url: "/fit-in/300/200/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFitIn, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fit-in with default background",
+		},
+		{
+			url: "/fit-in/300/200/bg:ff000080/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFitIn, Width: 300, Height: 200, Background: color.NRGBA{R: 255, A: 128}, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Fit-in with background",
+		},
+		{
+			url: "/stretch/300/200/domain.me:8080/pic.jpg", opts: converter.Options{Mode: converter.ModeStretch, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Stretch",
+		},
+		{
+			url: "/crop/10/20/300/200/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeCrop, X: 10, Y: 20, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Crop",
+		},
+		{
+			url: "/crop/10/20/300/domain.me/pic.jpg", err: true, msg: "Crop without height",
+		},
+		{
+			url: "/crop/10/20/300/200", err: true, msg: "Crop without origin",
+		},
+		{
+			url: "/fill/300/200/bg:ff0000/domain.me/pic.jpg", err: true, msg: "Background for fill",
+		},
+		{
+			url: "/fit-in/300/200/bg:red/domain.me/pic.jpg", err: true, msg: "Not valid background",
+		},
+		{
+			url: "/fit-in/300/200/bg:ff0000", err: true, msg: "Only options",
+		},
+		{
+			url: "/zoom/300/200/domain.me/pic.jpg", err: true, msg: "Unknown mode",
+		},
+		{
+			url: "/fit/300/200/format:png/q:65/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFit, Width: 300, Height: 200, Background: white, Format: converter.FormatPNG, Quality: 65, MaxFrames: 100, MaxPixels: 50000000}, msg: "Format and quality",
+		},
+		{
+			url: "/fit/300/200/format:JPG/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFit, Width: 300, Height: 200, Background: white, Format: converter.FormatJPEG, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Format alias",
+		},
+		{
+			url: "/fit/300/200/format:bmp/domain.me/pic.jpg", err: true, msg: "Unknown format",
+		},
+		{
+			url: "/fit/300/200/q:0/domain.me/pic.jpg", err: true, msg: "Quality below min",
+		},
+		{
+			url: "/fit/300/200/q:101/domain.me/pic.jpg", err: true, msg: "Quality above max",
+		},
+		{
+			url: "/fit/300/200/q:high/domain.me/pic.jpg", err: true, msg: "Quality is not a number",
+		},
+		{
+			url: "/crop/-10/20/300/200/domain.me/pic.jpg", err: true, msg: "Negative crop offset",
+		},
+		{
+			url: "/crop/1/0/9223372036854775807/10/domain.me/pic.jpg", err: true, msg: "Crop area overflow",
+		},
+		{
+			url: "/fill/-300/200/domain.me/pic.jpg", err: true, msg: "Negative width",
+		},
+		{
+			url: "/stretch/100000/200/domain.me/pic.jpg", err: true, msg: "Width above max size",
+		},
+		{
+			url: "/fit-in/300/8193/domain.me/pic.jpg", err: true, msg: "Height above max size",
+		},
+		{
+			url: "/fill/8192/8192/domain.me/pic.jpg", err: true, msg: "Area above max pixels",
+		},
+		{
+			url: "/fit-in/8000/6250/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFitIn, Width: 8000, Height: 6250, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Area at max pixels",
+		},
+		{
+			url: "/crop/0/0/10000/10000/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeCrop, Width: 10000, Height: 10000, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Crop is limited by the source only",
+		},
+		{
+			url: "/fit/300/200/meta:keep/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFit, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, KeepMeta: true, MaxPixels: 50000000}, msg: "Keep metadata",
+		},
+		{
+			url: "/fit/300/200/meta:strip/domain.me/pic.jpg", opts: converter.Options{Mode: converter.ModeFit, Width: 300, Height: 200, Background: white, Quality: 80, MaxFrames: 100, MaxPixels: 50000000}, msg: "Strip metadata",
+		},
+		{
+			url: "/fit/300/200/meta:all/domain.me/pic.jpg", err: true, msg: "Not valid meta",
+		},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			u, err := url.Parse(dat.url)
+			require.NoError(t, err)
+			query, err := buildQuery(u, conf)
+			require.Equal(t, dat.err, err != nil, dat.msg)
+			require.Equal(t, dat.opts, query.Options, dat.msg)
+		})
+	}
+}
+
+func TestQueryID(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	parse := func(u string) Query {
+		res, err := url.Parse(u)
+		require.NoError(t, err)
+		q, err := buildQuery(res, conf)
+		require.NoError(t, err)
+		return q
+	}
+
+	require.Equal(t, parse("/fill/10/10/domain.me/pic.jpg").id(), parse("/fill/10/10/http/domain.me/pic.jpg").id())
+	require.NotEqual(t, parse("/fill/10/10/domain.me/pic.jpg").id(), parse("/fill/10/10/https/domain.me/pic.jpg").id())
+	require.NotEqual(t, parse("/fill/10/10/domain.me/pic.jpg?token=1").id(), parse("/fill/10/10/domain.me/pic.jpg?token=2").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/b.com/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/a.com:8080/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/200/a.com/x.jpg").id(), parse("/fill/200/100/a.com/x.jpg").id())
+	require.Equal(t, parse("/fill/100/100/A.com/x.jpg").id(), parse("/fill/100/100/a.com:80/x.jpg").id())
+	require.Equal(t, parse("/fill/100/100/https/a.com/x.jpg").id(), parse("/fill/100/100/https/a.com:443/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fit/100/100/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/g:north/a.com/x.jpg").id())
+	require.Equal(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/g:center/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/fit-in/100/100/a.com/x.jpg").id(), parse("/fit-in/100/100/bg:000/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/crop/0/0/100/100/a.com/x.jpg").id(), parse("/crop/0/10/100/100/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/q:50/a.com/x.jpg").id())
+	require.Equal(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/q:80/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/format:png/a.com/x.jpg").id())
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), parse("/fill/100/100/meta:keep/a.com/x.jpg").id())
+	webp := parse("/fill/100/100/a.com/x.jpg")
+	webp.Prefer = converter.FormatWebP
+	require.NotEqual(t, parse("/fill/100/100/a.com/x.jpg").id(), webp.id())
+	require.Len(t, parse("/fill/100/100/a.com/"+strings.Repeat("очень-длинный-путь/", 100)+"x.jpg").id(), 64)
+}
+
+func TestFromOrigin(t *testing.T) {
+	var got *url.URL
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL
+		_, _ = w.Write([]byte("pic"))
+	}))
+	defer origin.Close()
+
+	u, err := url.Parse("/fill/10/10/" + url.PathEscape(origin.URL+"/some/pic.jpg?token=abc") + "?exp=1")
+	require.NoError(t, err)
+	var conf config.Config
+	conf.SetDefault()
+	q, err := buildQuery(u, conf)
+	require.NoError(t, err)
+
+	body, res, err := q.fromOrigin(context.Background(), &http.Client{Timeout: time.Second}, http.Header{}, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, []byte("pic"), body)
+	require.Equal(t, "/some/pic.jpg", got.Path)
+	require.Equal(t, "token=abc&exp=1", got.RawQuery)
+}
+
+func TestFromOriginSizeLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Без Content-Length: размер известен только при чтении.
+			for i := 0; i < 10; i++ {
+				_, _ = w.Write(body[:100])
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer origin.Close()
+
+	var conf config.Config
+	conf.SetDefault()
+	table := []struct {
+		path  string
+		limit int64
+		err   bool
+		msg   string
+	}{
+		{path: "/pic", limit: 0, msg: "No limit"},
+		{path: "/pic", limit: 1000, msg: "Exactly at limit"},
+		{path: "/pic", limit: 999, err: true, msg: "Content-Length above limit"},
+		{path: "/chunked", limit: 1000, msg: "Streamed body at limit"},
+		{path: "/chunked", limit: 500, err: true, msg: "Streamed body above limit"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			u, err := url.Parse("/fill/10/10/" + url.PathEscape(origin.URL+dat.path))
+			require.NoError(t, err)
+			q, err := buildQuery(u, conf)
+			require.NoError(t, err)
+			got, _, err := q.fromOrigin(context.Background(), &http.Client{Timeout: time.Second}, http.Header{}, dat.limit, nil)
+			if dat.err {
+				require.True(t, errors.Is(err, ErrOriginTooLarge), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, got, len(body))
+		})
+	}
+}
+
+func TestFromOriginConditional(t *testing.T) {
+	const etag, modified = `"v1"`, "Tue, 01 Dec 2020 09:00:00 GMT"
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("pic"))
+	}))
+	defer origin.Close()
+
+	u, err := url.Parse("/fill/10/10/" + url.PathEscape(origin.URL+"/pic.jpg"))
+	require.NoError(t, err)
+	var conf config.Config
+	conf.SetDefault()
+	q, err := buildQuery(u, conf)
+	require.NoError(t, err)
+	client := &http.Client{Timeout: time.Second}
+
+	// Условные заголовки клиента не доходят до origin'а.
+	h := http.Header{"If-None-Match": {etag}, "If-Modified-Since": {modified}}
+	body, res, err := q.fromOrigin(context.Background(), client, h, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, []byte("pic"), body)
+	require.Empty(t, got.Get("If-None-Match"))
+	require.Empty(t, got.Get("If-Modified-Since"))
+	require.Equal(t, etag, h.Get("If-None-Match"), "headers of caller must not be modified")
+
+	body, res, err = q.fromOrigin(context.Background(), client, http.Header{}, 0, &cache.Meta{ETag: etag, LastModified: modified})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotModified, res.StatusCode)
+	require.Empty(t, body)
+	require.Equal(t, etag, got.Get("If-None-Match"))
+	require.Equal(t, modified, got.Get("If-Modified-Since"))
+}
@@ -0,0 +1,123 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var ErrOverloaded = errors.New("converter is overloaded")
+
+// scheduler ограничивает число одновременных конвертаций. Задача ждет
+// свободного воркера в очереди ограниченной длины; при полной очереди или
+// слишком долгом ожидании возвращается ErrOverloaded.
+type scheduler struct {
+	workers chan struct{}
+	admit   chan struct{} // воркеры + места в очереди
+	timeout time.Duration
+
+	queued    int64
+	busy      int64
+	rejected  int64
+	timedOut  int64
+	waitCount int64
+	waitTotal int64 // нс
+	waitMax   int64 // нс
+}
+
+// schedulerStats - метрики планировщика, публикуются через expvar.
+type schedulerStats struct {
+	Workers   int
+	Busy      int64
+	Queued    int64
+	Rejected  int64
+	TimedOut  int64
+	WaitCount int64
+	WaitAvgMs float64
+	WaitMaxMs float64
+}
+
+// newScheduler создает планировщик на workers воркеров (0 - по числу CPU) с
+// очередью queueSize задач и временем ожидания в очереди timeout. При timeout <= 0
+// задача ждет воркера без ограничения, пока не отменен ее контекст.
+func newScheduler(workers, queueSize int, timeout time.Duration) *scheduler {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &scheduler{
+		workers: make(chan struct{}, workers),
+		admit:   make(chan struct{}, workers+queueSize),
+		timeout: timeout,
+	}
+}
+
+// run выполняет fn на свободном воркере.
+func (s *scheduler) run(ctx context.Context, fn func()) error {
+	select {
+	case s.admit <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.rejected, 1)
+		return fmt.Errorf("%w: queue is full", ErrOverloaded)
+	}
+	defer func() { <-s.admit }()
+
+	start := time.Now()
+	atomic.AddInt64(&s.queued, 1)
+	var timeout <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case s.workers <- struct{}{}:
+		atomic.AddInt64(&s.queued, -1)
+	case <-timeout:
+		atomic.AddInt64(&s.queued, -1)
+		atomic.AddInt64(&s.timedOut, 1)
+		return fmt.Errorf("%w: no free worker in %s", ErrOverloaded, s.timeout)
+	case <-ctx.Done():
+		atomic.AddInt64(&s.queued, -1)
+		return ctx.Err()
+	}
+	defer func() { <-s.workers }()
+	s.observeWait(time.Since(start))
+
+	atomic.AddInt64(&s.busy, 1)
+	defer atomic.AddInt64(&s.busy, -1)
+	fn()
+	return nil
+}
+
+func (s *scheduler) observeWait(d time.Duration) {
+	atomic.AddInt64(&s.waitCount, 1)
+	atomic.AddInt64(&s.waitTotal, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.waitMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.waitMax, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *scheduler) stats() interface{} {
+	st := schedulerStats{
+		Workers:   cap(s.workers),
+		Busy:      atomic.LoadInt64(&s.busy),
+		Queued:    atomic.LoadInt64(&s.queued),
+		Rejected:  atomic.LoadInt64(&s.rejected),
+		TimedOut:  atomic.LoadInt64(&s.timedOut),
+		WaitCount: atomic.LoadInt64(&s.waitCount),
+		WaitMaxMs: float64(atomic.LoadInt64(&s.waitMax)) / float64(time.Millisecond),
+	}
+	if st.WaitCount > 0 {
+		st.WaitAvgMs = float64(atomic.LoadInt64(&s.waitTotal)) / float64(st.WaitCount) / float64(time.Millisecond)
+	}
+	return st
+}
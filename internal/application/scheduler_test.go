@@ -0,0 +1,158 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(1, 1, 50*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		require.NoError(t, s.run(context.Background(), func() {
+			close(started)
+			<-release
+		}))
+	}()
+	<-started
+
+	// Воркер занят: вторая задача ждет в очереди и не дожидается.
+	queued := make(chan error)
+	go func() { queued <- s.run(context.Background(), func() {}) }()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int64(1), s.stats().(schedulerStats).Queued)
+
+	// Очередь полна: третья задача отклоняется сразу.
+	err := s.run(context.Background(), func() {})
+	require.True(t, errors.Is(err, ErrOverloaded), err)
+
+	err = <-queued
+	require.True(t, errors.Is(err, ErrOverloaded), err)
+
+	close(release)
+	wg.Wait()
+	require.NoError(t, s.run(context.Background(), func() {}))
+
+	st := s.stats().(schedulerStats)
+	require.Equal(t, 1, st.Workers)
+	require.Equal(t, int64(0), st.Busy)
+	require.Equal(t, int64(0), st.Queued)
+	require.Equal(t, int64(1), st.Rejected)
+	require.Equal(t, int64(1), st.TimedOut)
+	require.Equal(t, int64(2), st.WaitCount)
+}
+
+func TestSchedulerContext(t *testing.T) {
+	s := newScheduler(1, 1, time.Second)
+	s.workers <- struct{}{} // воркер занят
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, s.run(ctx, func() {}))
+}
+
+func TestSchedulerNoTimeout(t *testing.T) {
+	s := newScheduler(1, 1, 0)
+	s.workers <- struct{}{} // воркер занят
+
+	// Без таймаута задача ждет воркера, а не отклоняется сразу.
+	done := make(chan error)
+	go func() { done <- s.run(context.Background(), func() {}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("task finished before worker was free: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-s.workers
+	require.NoError(t, <-done)
+	require.Equal(t, int64(0), s.stats().(schedulerStats).TimedOut)
+
+	// Ожидание прерывается только контекстом.
+	s.workers <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, s.run(ctx, func() {}))
+}
+
+func TestSchedulerLimitsConcurrency(t *testing.T) {
+	s := newScheduler(3, 100, time.Second)
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, s.run(context.Background(), func() {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}))
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, peak, 3)
+}
+
+func TestHandlerOverloaded(t *testing.T) {
+	origin, _ := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pic"))
+	})
+	var conf config.Config
+	conf.SetDefault()
+	s := newScheduler(1, 0, 2*time.Second)
+	s.admit <- struct{}{} // единственное место занято
+	h := newTestHandler(t, conf, newTestCache(t), s)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fill/10/10/"+origin.Listener.Addr().String()+"/pic.jpg", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	currentScheduler.Store(newScheduler(4, 8, time.Second))
+	h := metricsHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"converter": {"Workers":4`)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fill/10/10/a.com/x.jpg", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMetricsNotPublic(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, newTestCache(t), nil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	require.NotEqual(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "cmdline")
+}
@@ -0,0 +1,125 @@
+package application
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+// entryMeta собирает метаданные записи кэша из ответа origin'а.
+func entryMeta(h http.Header, now time.Time, conf config.Config) cache.Meta {
+	return cache.Meta{
+		Fetched:      now,
+		Expires:      now.Add(entryTTL(h, now, conf)),
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+
+		StaleWhileRevalidate: staleWindow(h, "stale-while-revalidate", conf.Cache.StaleWhileRevalidate),
+		StaleIfError:         staleWindow(h, "stale-if-error", conf.Cache.StaleIfError),
+	}
+}
+
+// refreshMeta обновляет метаданные записи по ответу 304: срок жизни
+// вычисляется заново, валидаторы заменяются присланными origin'ом.
+func refreshMeta(old cache.Meta, h http.Header, now time.Time, conf config.Config) cache.Meta {
+	m := entryMeta(h, now, conf)
+	if m.ETag == "" {
+		m.ETag = old.ETag
+	}
+	if m.LastModified == "" {
+		m.LastModified = old.LastModified
+	}
+	return m
+}
+
+// staleWindow возвращает, сколько запись можно отдавать после истечения срока
+// жизни: по директиве directive (stale-while-revalidate или stale-if-error)
+// из Cache-Control, а без нее - def секунд из конфигурации.
+func staleWindow(h http.Header, directive string, def int) time.Duration {
+	if n, err := strconv.Atoi(cacheControl(h)[directive]); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(def) * time.Second
+}
+
+// cacheControl разбирает директивы Cache-Control. Имена приводятся к нижнему
+// регистру, при повторах действует первая.
+func cacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := cc[name]; !ok && name != "" {
+				cc[name] = value
+			}
+		}
+	}
+	return cc
+}
+
+// storable сообщает, можно ли сохранять ответ origin'а в кэш: no-store и
+// private это запрещают.
+func storable(h http.Header) bool {
+	cc := cacheControl(h)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// entryTTL вычисляет срок жизни записи по Cache-Control (s-maxage важнее
+// max-age) или Expires. Без этих заголовков действует DefaultTTL; результат
+// ограничивается MinTTL и MaxTTL. Запись с no-cache сразу требует
+// перепроверки, MinTTL к ней не применяется.
+func entryTTL(h http.Header, now time.Time, conf config.Config) time.Duration {
+	if _, ok := cacheControl(h)["no-cache"]; ok {
+		return 0
+	}
+	ttl, ok := originTTL(h, now)
+	if !ok {
+		ttl = time.Duration(conf.Cache.DefaultTTL) * time.Second
+	}
+	if min := time.Duration(conf.Cache.MinTTL) * time.Second; ttl < min {
+		ttl = min
+	}
+	if max := time.Duration(conf.Cache.MaxTTL) * time.Second; max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// originTTL возвращает срок жизни, заданный origin'ом, и признак того, что он задан.
+func originTTL(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := cacheControl(h)
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if n, err := strconv.Atoi(cc[d]); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	v := h.Get("Expires")
+	if v == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(v)
+	if err != nil {
+		// Некорректный Expires означает "уже истек".
+		return 0, true
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		now = date
+	}
+	if ttl := expires.Sub(now); ttl > 0 {
+		return ttl, true
+	}
+	return 0, true
+}
@@ -0,0 +1,307 @@
+package application
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tiburon-777/OTUS_Project/internal/cache"
+	"github.com/tiburon-777/OTUS_Project/internal/config"
+)
+
+func TestEntryTTL(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Cache.DefaultTTL, conf.Cache.MinTTL, conf.Cache.MaxTTL = 600, 10, 3600
+	now := time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Minute).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		ttl    time.Duration
+	}{
+		{"no headers", http.Header{}, 600 * time.Second},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=120"}}, 120 * time.Second},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=120, s-maxage=300"}}, 300 * time.Second},
+		{"several headers", http.Header{"Cache-Control": {"public", "max-age=120"}}, 120 * time.Second},
+		{"no-cache", http.Header{"Cache-Control": {"max-age=120, no-cache"}}, 0},
+		{"clamped to max", http.Header{"Cache-Control": {"max-age=31536000"}}, 3600 * time.Second},
+		{"clamped to min", http.Header{"Cache-Control": {"max-age=0"}}, 10 * time.Second},
+		{"bad max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 600 * time.Second},
+		{"expires", http.Header{"Expires": {now.Add(20 * time.Minute).Format(http.TimeFormat)}}, 20 * time.Minute},
+		{"expires with date", http.Header{"Expires": {now.Add(20 * time.Minute).Format(http.TimeFormat)}, "Date": {date}}, 21 * time.Minute},
+		{"expires in past", http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 10 * time.Second},
+		{"bad expires", http.Header{"Expires": {"0"}}, 10 * time.Second},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=120"}, "Expires": {"0"}}, 120 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.ttl, entryTTL(tt.header, now, conf))
+		})
+	}
+
+	h := http.Header{"Etag": {`"v1"`}, "Last-Modified": {date}, "Cache-Control": {"max-age=120, stale-while-revalidate=30"}}
+	m := entryMeta(h, now, conf)
+	require.Equal(t, cache.Meta{
+		Fetched: now, Expires: now.Add(120 * time.Second), ETag: `"v1"`, LastModified: date,
+		StaleWhileRevalidate: 30 * time.Second, StaleIfError: 24 * time.Hour,
+	}, m)
+}
+
+func TestStorable(t *testing.T) {
+	require.True(t, storable(http.Header{}))
+	require.True(t, storable(http.Header{"Cache-Control": {"public, no-cache"}}))
+	require.False(t, storable(http.Header{"Cache-Control": {"no-store"}}))
+	require.False(t, storable(http.Header{"Cache-Control": {"max-age=120", "Private"}}))
+}
+
+func TestHandlerNoStore(t *testing.T) {
+	pic := testPic(t)
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		_, _ = w.Write(pic)
+	})
+
+	c := newTestCache(t)
+	var conf config.Config
+	conf.SetDefault()
+	conf.Cache.MinTTL = 60
+	h := newTestHandler(t, conf, c, nil)
+
+	// Ответы с no-store и private отдаются клиенту, но в кэш не попадают.
+	for i, cc := range []string{"no-store", "private, max-age=120"} {
+		path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg?cc="+url.QueryEscape(cc))
+		for j := 0; j < 2; j++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NotEmpty(t, w.Body.Bytes())
+			require.Empty(t, w.Header().Get("X-From-Appcache"))
+		}
+		require.Equal(t, int64(2*(i+1)), atomic.LoadInt64(hits))
+		q, err := buildQuery(httptest.NewRequest("GET", path, nil).URL, conf)
+		require.NoError(t, err)
+		_, ok, err := c.Get(cache.Key(q.id()))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+}
+
+func TestStaleWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		window time.Duration
+	}{
+		{"default", http.Header{}, 5 * time.Second},
+		{"directive", http.Header{"Cache-Control": {"max-age=60, stale-if-error=600"}}, 10 * time.Minute},
+		{"zero directive", http.Header{"Cache-Control": {"stale-if-error=0"}}, 0},
+		{"upper case", http.Header{"Cache-Control": {"Stale-If-Error=\"20\""}}, 20 * time.Second},
+		{"bad directive", http.Header{"Cache-Control": {"stale-if-error=-1"}}, 5 * time.Second},
+		{"other directive", http.Header{"Cache-Control": {"stale-while-revalidate=20"}}, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.window, staleWindow(tt.header, "stale-if-error", 5))
+		})
+	}
+}
+
+func TestHandlerExpiredEntry(t *testing.T) {
+	pic := testPic(t)
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write(pic)
+	})
+
+	c := newTestCache(t)
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, c, nil)
+
+	path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg")
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+	get()
+	w := get()
+	require.Equal(t, "true", w.Header().Get("X-From-Appcache"))
+	require.Equal(t, int64(1), atomic.LoadInt64(hits))
+
+	// Просроченная запись загружается заново.
+	q, err := buildQuery(httptest.NewRequest("GET", path, nil).URL, conf)
+	require.NoError(t, err)
+	key := cache.Key(q.id())
+	v, ok, err := c.Get(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	e := v.(cache.Entry)
+	require.WithinDuration(t, time.Now().Add(time.Hour), e.Expires, time.Minute)
+	e.Expires = time.Now().Add(-time.Second)
+	_, err = c.Set(key, e)
+	require.NoError(t, err)
+
+	w = get()
+	require.Empty(t, w.Header().Get("X-From-Appcache"))
+	require.Equal(t, int64(2), atomic.LoadInt64(hits))
+}
+
+func TestHandlerRevalidation(t *testing.T) {
+	pic := testPic(t)
+	var notModified int64
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(pic)
+	})
+
+	c := newTestCache(t)
+	var conf config.Config
+	conf.SetDefault()
+	h := newTestHandler(t, conf, c, nil)
+
+	path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg")
+	q, err := buildQuery(httptest.NewRequest("GET", path, nil).URL, conf)
+	require.NoError(t, err)
+	key := cache.Key(q.id())
+	expire := func(etag string) {
+		v, ok, err := c.Get(key)
+		require.NoError(t, err)
+		require.True(t, ok)
+		e := v.(cache.Entry)
+		// Подменяем превью, чтобы отличить отданное из кэша от сконвертированного заново.
+		e.Value, e.ETag, e.Expires = []byte("cached"), etag, time.Now().Add(-time.Second)
+		_, err = c.Set(key, e)
+		require.NoError(t, err)
+	}
+	get := func() []byte {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.Bytes()
+	}
+	get()
+
+	// 304: отдается сохраненное превью, срок жизни продлевается.
+	expire(`"v1"`)
+	require.Equal(t, []byte("cached"), get())
+	require.Equal(t, int64(2), atomic.LoadInt64(hits))
+	require.Equal(t, int64(1), atomic.LoadInt64(&notModified))
+	v, _, err := c.Get(key)
+	require.NoError(t, err)
+	require.True(t, v.(cache.Entry).Fresh(time.Now()))
+	require.Equal(t, []byte("cached"), get())
+	require.Equal(t, int64(2), atomic.LoadInt64(hits))
+
+	// 200: оригинал изменился, превью конвертируется заново.
+	expire(`"v0"`)
+	require.NotEqual(t, []byte("cached"), get())
+	require.Equal(t, int64(3), atomic.LoadInt64(hits))
+	require.Equal(t, int64(1), atomic.LoadInt64(&notModified))
+}
+
+// staleSetup поднимает handler над origin'ом, отвечающим статусом *status
+// (-1 - обрыв соединения), и возвращает функцию, кладущую в кэш запись с
+// превью "cached", просроченную на age, и счетчик запросов к origin'у.
+func staleSetup(t *testing.T, conf config.Config, status *int64) (http.Handler, string, func(age time.Duration), *int64) {
+	pic := testPic(t)
+	origin, hits := testOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		s := int(atomic.LoadInt64(status))
+		if s < 0 {
+			panic(http.ErrAbortHandler)
+		}
+		if s != http.StatusOK {
+			w.WriteHeader(s)
+			return
+		}
+		_, _ = w.Write(pic)
+	})
+
+	c := newTestCache(t)
+	h := newTestHandler(t, conf, c, nil)
+
+	path := "/fill/32/32/" + url.PathEscape(origin.URL+"/pic.jpg")
+	q, err := buildQuery(httptest.NewRequest("GET", path, nil).URL, conf)
+	require.NoError(t, err)
+	expire := func(age time.Duration) {
+		now := time.Now()
+		meta := entryMeta(http.Header{}, now, conf)
+		meta.Expires = now.Add(-age)
+		_, err := c.Set(cache.Key(q.id()), cache.Entry{Value: []byte("cached"), Meta: meta})
+		require.NoError(t, err)
+	}
+	return h, path, expire, hits
+}
+
+func TestHandlerStaleWhileRevalidate(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Cache.StaleWhileRevalidate = 60
+	status := int64(http.StatusOK)
+	h, path, expire, hits := staleSetup(t, conf, &status)
+
+	// В пределах окна отдается старое превью, а запись обновляется в фоне.
+	expire(30 * time.Second)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "STALE", w.Header().Get("X-Cache"))
+	require.Equal(t, []byte("cached"), w.Body.Bytes())
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Header().Get("X-Cache") == "HIT" && !bytes.Equal(w.Body.Bytes(), []byte("cached"))
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), atomic.LoadInt64(hits))
+}
+
+func TestHandlerStaleIfError(t *testing.T) {
+	var conf config.Config
+	conf.SetDefault()
+	conf.Cache.StaleIfError = 60
+	status := int64(http.StatusBadGateway)
+	h, path, expire, _ := staleSetup(t, conf, &status)
+
+	tests := []struct {
+		name   string
+		status int64
+		age    time.Duration
+		code   int
+		stale  bool
+	}{
+		{"origin error within window", http.StatusBadGateway, 30 * time.Second, http.StatusOK, true},
+		{"connection aborted", -1, 30 * time.Second, http.StatusOK, true},
+		{"origin error out of window", http.StatusBadGateway, 2 * time.Minute, http.StatusBadGateway, false},
+		{"not found is not an error", http.StatusNotFound, 30 * time.Second, http.StatusNotFound, false},
+		{"origin is back", http.StatusOK, 30 * time.Second, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&status, tt.status)
+			expire(tt.age)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			require.Equal(t, tt.code, w.Code)
+			if tt.stale {
+				require.Equal(t, "STALE", w.Header().Get("X-Cache"))
+				require.Equal(t, []byte("cached"), w.Body.Bytes())
+				return
+			}
+			require.NotEqual(t, "STALE", w.Header().Get("X-Cache"))
+		})
+	}
+}
@@ -1,36 +1,210 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"regexp"
 	"sync"
+	"time"
 )
 
 type Key string
 
+// ErrTooLarge возвращается, если значение не помещается в кэш даже пустой
+// (в шардированном кэше - в свой шард).
+var ErrTooLarge = errors.New("value exceeds cache size limit")
+
+var fileNameRe = regexp.MustCompile(`^[0-9a-f]{64}(\.meta)?$`)
+
+// tmpNameRe - временные файлы значений и индекса, оставшиеся после аварийного
+// завершения.
+var tmpNameRe = regexp.MustCompile(`^([0-9a-f]{64}(\.meta)?\.[0-9]+|index)\.tmp$`)
+
+const (
+	// metaExt - расширение файла с метаданными Entry рядом с файлом значения.
+	metaExt = ".meta"
+	// indexFile - индекс, сохраняемый при Close для быстрого старта.
+	indexFile = "index"
+	// tmpExt - расширение недописанных файлов: в каталог кэша значение
+	// попадает только целиком, переименованием.
+	tmpExt = ".tmp"
+	// maxReads - сколько раз Get перечитывает значение, заменяемое параллельной
+	// записью, прежде чем считать его отсутствующим.
+	maxReads = 3
+)
+
 type Cache interface {
 	Set(key Key, value interface{}) (bool, error) // Добавить значение в кэш по ключу
 	Get(key Key) (interface{}, bool, error)       // Получить значение из кэша по ключу
 	Clear() error                                 // Очистить кэш
+	Close() error                                 // Сохранить состояние и освободить ресурсы
 }
 
-type lruCache struct {
+// Options - параметры кэша. Нулевые Capacity и MaxBytes не ограничивают кэш.
+type Options struct {
+	Capacity int    // максимум значений
+	MaxBytes int64  // максимум суммарного размера файлов
+	Path     string // каталог с файлами кэша
+	Index    bool   // сохранять порядок вытеснения при Close
+	// Shards - число независимых шардов, делящих между собой Capacity и
+	// MaxBytes. Одно значение не может быть больше доли шарда, MaxBytes/Shards.
+	Shards int
+
+	Policy    string // политика вытеснения: lru (по умолчанию), lfu или arc
+	Admission string // фильтр допуска новых значений: tinylfu или пусто
+
+	MemoryBytes int64 // размер уровня в памяти перед хранилищем, 0 - без него
+
+	Backend string // хранилище: disk (по умолчанию), redis или s3 с диском перед ним
+
+	// Параметры redis. Значения хранятся под ключами Prefix + sha256 от ключа
+	// кэша; без метаданных - TTL, с ними - пока запись пригодна к отдаче.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	Prefix        string
+	TTL           time.Duration
+	MaxValueBytes int64 // максимум размера одного значения, 0 - без ограничения
+
+	// Параметры S3-совместимого хранилища: объекты лежат в бакете под ключами
+	// Prefix + sha256 от ключа кэша, адресация по пути.
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+}
+
+type diskCache struct {
 	capacity int
+	maxBytes int64
+	size     int64 // суммарный размер файлов значений и метаданных
 	path     string
-	queue    *List
-	items    map[Key]*ListItem
+	index    bool
+	gen      uint64 // счетчик версий значений
+	items    map[Key]Item
 	mx       sync.Mutex
+
+	policy       policy
+	admission    admission // nil - пускать все
+	newPolicy    func() policy
+	newAdmission func() admission
 }
 
+// Item - значение в индексе кэша. Key - имя файла значения (sha256 от ключа
+// кэша): по нему индекс восстанавливается из каталога.
 type Item struct {
 	Key   Key
 	Value interface{}
+	Size  int64
+	gen   uint64 // версия файлов значения, меняется при каждой записи
 }
 
-func NewCache(capacity int, path string) (Cache, error) {
+// Entry - значение вместе с метаданными. Set сохраняет метаданные Entry рядом
+// со значением, а Get возвращает Entry для значений, сохраненных с ними, и
+// []byte для остальных.
+type Entry struct {
+	Value []byte `json:"-"`
+	Meta
+}
+
+// Meta описывает происхождение и срок жизни значения.
+type Meta struct {
+	Fetched      time.Time // когда получен оригинал
+	Expires      time.Time // до какого момента значение свежее
+	ETag         string    `json:",omitempty"`
+	LastModified string    `json:",omitempty"`
+
+	// Сколько после Expires запись можно отдавать, обновляя ее в фоне, и
+	// сколько - при недоступности origin'а.
+	StaleWhileRevalidate time.Duration `json:",omitempty"`
+	StaleIfError         time.Duration `json:",omitempty"`
+
+	// AnyAccept - формат значения не зависит от Accept клиента (например,
+	// анимация осталась GIF), и запись годится для любых клиентов.
+	AnyAccept bool `json:",omitempty"`
+}
+
+// Fresh сообщает, не истек ли срок жизни значения к моменту now.
+func (e Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Usable сообщает, можно ли к моменту now отдать запись, просроченную не
+// более чем на window.
+func (e Entry) Usable(now time.Time, window time.Duration) bool {
+	return now.Before(e.Expires.Add(window))
+}
+
+// NewCache создает LRU-кэш в каталоге path, хранящий не больше capacity
+// значений общим размером не больше maxBytes байт.
+func NewCache(capacity int, maxBytes int64, path string) (Cache, error) {
+	return New(Options{Capacity: capacity, MaxBytes: maxBytes, Path: path})
+}
+
+// New создает кэш на выбранном в Backend хранилище. При MemoryBytes > 0 перед
+// ним ставится уровень в памяти.
+func New(o Options) (Cache, error) {
+	var (
+		c   Cache
+		err error
+	)
+	switch o.Backend {
+	case "", "disk":
+		c, err = newDiskCache(o)
+	case "redis":
+		c, err = newRedisCache(o)
+	case "s3":
+		c, err = newS3Backend(o)
+	default:
+		err = fmt.Errorf("unknown cache backend %q", o.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.MemoryBytes > 0 {
+		c = newTieredCache(c, o.MemoryBytes)
+	}
+	return c, nil
+}
+
+// minShardItems - сколько значений должно помещаться в шард. Ключи ложатся
+// по шардам неравномерно, и в совсем маленьких шардах значения вытеснялись бы
+// задолго до заполнения всего кэша.
+const minShardItems = 8
+
+// newDiskCache создает кэш в каталоге Path и восстанавливает его из файлов,
+// оставшихся там. При Shards > 1 значения распределяются по хэшу между
+// независимыми шардами; шардов делается не больше, чем позволяет minShardItems.
+func newDiskCache(o Options) (Cache, error) {
+	n := o.Shards
+	if n < 1 {
+		n = 1
+	}
+	if max := o.Capacity / minShardItems; o.Capacity > 0 && n > 1 && n > max {
+		if max < 1 {
+			max = 1
+		}
+		log.Printf("cache capacity %d is too small for %d shards, using %d\n", o.Capacity, n, max)
+		n = max
+	}
+	capacity := (o.Capacity + n - 1) / n
+	newPolicy, err := newPolicy(o.Policy)
+	if err != nil {
+		return nil, err
+	}
+	newAdmission, err := newAdmission(o.Admission, capacity)
+	if err != nil {
+		return nil, err
+	}
+	path := o.Path
 	if _, err := ioutil.ReadDir(path); err != nil {
 		log.Printf("cache directory %s not exists. Try to create.\n", path)
 		err = os.MkdirAll(path, 0777)
@@ -38,91 +212,286 @@ func NewCache(capacity int, path string) (Cache, error) {
 			return nil, fmt.Errorf("can't create cache directory %s:\n %w", path, err)
 		}
 	}
-	return &lruCache{
-		capacity: capacity,
-		path:     path,
-		queue:    NewList(),
-		items:    make(map[Key]*ListItem),
-	}, nil
+	if err := migrate(path); err != nil {
+		return nil, fmt.Errorf("can't migrate cache directory %s:\n %w", path, err)
+	}
+	names, err := readNames(path)
+	if err != nil {
+		return nil, err
+	}
+	indexed, err := readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*diskCache, n)
+	for i := range shards {
+		shards[i] = &diskCache{
+			capacity:     capacity,
+			maxBytes:     (o.MaxBytes + int64(n) - 1) / int64(n),
+			path:         path,
+			index:        o.Index,
+			newPolicy:    newPolicy,
+			newAdmission: newAdmission,
+		}
+		shards[i].reset()
+		if err := shards[i].restore(ownNames(names, i, n), ownItems(indexed, i, n)); err != nil {
+			return nil, fmt.Errorf("can't restore cache from %s:\n %w", path, err)
+		}
+	}
+	if n > 1 {
+		return &shardedCache{shards: shards, index: o.Index}, nil
+	}
+	return shards[0], nil
+}
+
+func (l *diskCache) Set(key Key, value interface{}) (bool, error) {
+	return l.set(fileKey(key), value)
 }
 
-func (l *lruCache) Set(key Key, value interface{}) (bool, error) {
+// set сохраняет значение в файл name. Содержимое пишется во временные файлы
+// вне блокировки; под ней они только переименовываются, а вытесненные -
+// удаляются.
+func (l *diskCache) set(name Key, value interface{}) (bool, error) {
+	data, meta, err := encode(value)
+	if err != nil {
+		return false, err
+	}
+	size := int64(len(data) + len(meta))
+	if l.maxBytes > 0 && size > l.maxBytes {
+		return false, fmt.Errorf("%w: %d bytes, limit is %d", ErrTooLarge, size, l.maxBytes)
+	}
+	tmp, err := l.writeTemp(name, data)
+	if err != nil {
+		return false, fmt.Errorf("can't save file %s:\n %w", l.filename(name), err)
+	}
+	tmpMeta := ""
+	if meta != nil {
+		if tmpMeta, err = l.writeTemp(name+metaExt, meta); err != nil {
+			_ = os.Remove(tmp)
+			return false, fmt.Errorf("can't save file %s:\n %w", l.filename(name)+metaExt, err)
+		}
+	}
 	l.mx.Lock()
 	defer l.mx.Unlock()
-	if _, exists := l.items[key]; exists {
-		err := l.loadOut(key, value)
-		if err != nil {
-			return false, fmt.Errorf("can't replace file %s:\n %w", path.Join([]string{l.path, string(key)}...), err)
+	if l.admission != nil {
+		l.admission.record(name)
+	}
+	// Заменяемое значение не учитывается при вытеснении: его файлы будут
+	// перезаписаны.
+	old, exists := l.items[name]
+	if exists {
+		l.size -= old.Size
+		l.policy.remove(name, false)
+		delete(l.items, name)
+	}
+	admitted := true
+	if !exists && l.admission != nil && l.full(1, size) {
+		if v, ok := l.policy.victim(name); ok {
+			admitted = l.admission.admit(name, v)
 		}
-		l.items[key].Value = Item{Value: value, Key: key}
-		l.queue.MoveToFront(l.items[key])
-		return exists, nil
 	}
-	if l.queue.Len() == l.capacity {
-		k, ok := l.queue.Back().Value.(Item)
-		if !ok {
-			return false, fmt.Errorf("can't cast type")
+	if admitted {
+		if err = l.evict(name, 1, size); err == nil {
+			err = l.commit(name, tmp, tmpMeta)
 		}
-		err := l.remove(k.Value.(Key))
-		if err != nil {
-			return false, fmt.Errorf("can't delete file %s:\n %w", path.Join([]string{l.path, k.Value.(string)}...), err)
+	}
+	if err != nil || !admitted {
+		_ = os.Remove(tmp)
+		if tmpMeta != "" {
+			_ = os.Remove(tmpMeta)
 		}
-		delete(l.items, k.Key)
-		l.queue.Remove(l.queue.Back())
 	}
-	err := l.loadOut(key, value)
 	if err != nil {
-		return false, fmt.Errorf("can't save file %s:\n %w", path.Join([]string{l.path, string(key)}...), err)
+		if exists {
+			// Старые файлы могли быть частично заменены.
+			_ = l.remove(name)
+		}
+		return false, fmt.Errorf("can't save file %s:\n %w", l.filename(name), err)
 	}
-	if l.items == nil {
-		l.items = make(map[Key]*ListItem)
+	if !admitted {
+		return false, nil
 	}
-	l.items[key] = l.queue.PushFront(Item{Value: key, Key: key})
-	return false, nil
+	l.gen++
+	l.size += size
+	l.items[name] = Item{Key: name, Size: size, gen: l.gen}
+	l.policy.add(name)
+	return exists, nil
 }
 
-func (l *lruCache) Get(key Key) (interface{}, bool, error) {
+// full сообщает, нужно ли вытеснение, чтобы добавить n значений размером size.
+func (l *diskCache) full(n int, size int64) bool {
+	return (l.capacity > 0 && len(l.items)+n > l.capacity) || (l.maxBytes > 0 && l.size+size > l.maxBytes)
+}
+
+// evict вытесняет значения, выбранные политикой, пока не освободится место
+// для n значений размером size ради candidate.
+func (l *diskCache) evict(candidate Key, n int, size int64) error {
+	for len(l.items) > 0 && l.full(n, size) {
+		name, ok := l.policy.victim(candidate)
+		if !ok {
+			return fmt.Errorf("eviction policy has no victim for %d items", len(l.items))
+		}
+		if err := l.remove(name); err != nil {
+			return fmt.Errorf("can't delete file %s:\n %w", l.filename(name), err)
+		}
+		l.size -= l.items[name].Size
+		delete(l.items, name)
+		l.policy.remove(name, true)
+	}
+	return nil
+}
+
+func (l *diskCache) Get(key Key) (interface{}, bool, error) {
+	return l.get(fileKey(key))
+}
+
+func (l *diskCache) touch(key Key) {
+	l.access(fileKey(key))
+}
+
+// access учитывает обращение к значению name без чтения файла.
+func (l *diskCache) access(name Key) {
 	l.mx.Lock()
 	defer l.mx.Unlock()
-	if l.items[key] == nil {
-		return nil, false, nil
+	if l.admission != nil {
+		l.admission.record(name)
 	}
-	l.queue.MoveToFront(l.items[key])
-	s, ok := l.items[key].Value.(Item)
-	if !ok {
-		return nil, false, fmt.Errorf("can't cast type")
+	if _, ok := l.items[name]; ok {
+		l.policy.access(name)
 	}
-	pic, err := l.loadIn(s.Key)
-	if err != nil {
-		return nil, false, fmt.Errorf("can't load file %s:\n %w", path.Join([]string{l.path, string(s.Key)}...), err)
+}
+
+// get читает значение из файла name вне блокировки. Если за время чтения
+// значение заменили или вытеснили, оно перечитывается.
+func (l *diskCache) get(name Key) (interface{}, bool, error) {
+	for i := 0; i < maxReads; i++ {
+		l.mx.Lock()
+		if l.admission != nil && i == 0 {
+			l.admission.record(name)
+		}
+		item, ok := l.items[name]
+		if !ok {
+			l.mx.Unlock()
+			return nil, false, nil
+		}
+		l.policy.access(name)
+		gen := item.gen
+		l.mx.Unlock()
+
+		pic, err := l.load(name)
+
+		l.mx.Lock()
+		item, ok = l.items[name]
+		changed := !ok || item.gen != gen
+		l.mx.Unlock()
+		if changed {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("can't load file %s:\n %w", l.filename(name), err)
+		}
+		// Время изменения файла отражает последнее использование: по нему
+		// восстанавливается порядок вытеснения, если индекс не сохранен.
+		now := time.Now()
+		_ = os.Chtimes(l.filename(name), now, now)
+		return pic, true, nil
 	}
-	return pic, true, nil
+	return nil, false, nil
 }
 
-func (l *lruCache) Clear() error {
+func (l *diskCache) Clear() error {
 	l.mx.Lock()
 	defer l.mx.Unlock()
-	err := l.drop()
+	err := drop(l.path)
 	if err != nil {
 		return fmt.Errorf("can't remove files from %s:\n %w", l.path, err)
 	}
-	l.items = nil
-	l.queue.len = 0
-	l.queue.Info = ListItem{}
+	l.reset()
 	return nil
 }
 
-func (l *lruCache) loadOut(name Key, pic interface{}) error {
-	filename := path.Join([]string{l.path, string(name)}...)
-	err := ioutil.WriteFile(filename, pic.([]byte), 0600)
+func (l *diskCache) reset() {
+	l.items = make(map[Key]Item)
+	l.size = 0
+	l.policy = l.newPolicy()
+	l.admission = l.newAdmission()
+}
+
+// encode возвращает содержимое файла значения и, для Entry, файла метаданных.
+func encode(value interface{}) ([]byte, []byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil, nil
+	case Entry:
+		meta, err := json.Marshal(v.Meta)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't marshal metadata:\n %w", err)
+		}
+		return v.Value, meta, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported value type %T", value)
+}
+
+// writeTemp записывает data во временный файл рядом с файлом name.
+func (l *diskCache) writeTemp(name Key, data []byte) (string, error) {
+	f, err := ioutil.TempFile(l.path, string(name)+".*"+tmpExt)
+	if err != nil {
+		return "", fmt.Errorf("can't create temporary file for %s:\n %w", name, err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("can't create or write file %s:\n %w", filename, err)
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("can't write file %s:\n %w", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
+// commit переименовывает временные файлы значения и метаданных в постоянные.
+// Без tmpMeta старые метаданные удаляются.
+func (l *diskCache) commit(name Key, tmp, tmpMeta string) error {
+	filename := l.filename(name)
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("can't rename file %s:\n %w", tmp, err)
+	}
+	if tmpMeta == "" {
+		if err := os.Remove(filename + metaExt); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't remove file %s:\n %w", filename+metaExt, err)
+		}
+		return nil
+	}
+	if err := os.Rename(tmpMeta, filename+metaExt); err != nil {
+		return fmt.Errorf("can't rename file %s:\n %w", tmpMeta, err)
 	}
 	return nil
 }
 
-func (l *lruCache) loadIn(name Key) ([]byte, error) {
-	filename := path.Join([]string{l.path, string(name)}...)
+// load читает значение и, если они есть, его метаданные.
+func (l *diskCache) load(name Key) (interface{}, error) {
+	pic, err := l.loadIn(name)
+	if err != nil {
+		return nil, err
+	}
+	filename := l.filename(name) + metaExt
+	meta, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return pic, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read file %s:\n %w", filename, err)
+	}
+	e := Entry{Value: pic}
+	if err = json.Unmarshal(meta, &e.Meta); err != nil {
+		return nil, fmt.Errorf("can't unmarshal metadata from %s:\n %w", filename, err)
+	}
+	return e, nil
+}
+
+func (l *diskCache) loadIn(name Key) ([]byte, error) {
+	filename := l.filename(name)
 	f, err := os.Open(filename)
 	defer func() {
 		_ = f.Close()
@@ -137,25 +506,64 @@ func (l *lruCache) loadIn(name Key) ([]byte, error) {
 	return res, nil
 }
 
-func (l *lruCache) remove(name Key) error {
-	filename := path.Join([]string{l.path, string(name)}...)
-	err := os.RemoveAll(filename)
+func (l *diskCache) remove(name Key) error {
+	filename := l.filename(name)
+	for _, f := range []string{filename, filename + metaExt} {
+		if err := os.RemoveAll(f); err != nil {
+			return fmt.Errorf("can't remove file %s:\n %w", f, err)
+		}
+	}
+	return nil
+}
+
+// fileKey возвращает имя файла значения - sha256 от ключа, поэтому ключ может
+// быть сколь угодно длинным и содержать любые символы.
+func fileKey(key Key) Key {
+	sum := sha256.Sum256([]byte(key))
+	return Key(hex.EncodeToString(sum[:]))
+}
+
+// filename возвращает путь к файлу значения с именем name.
+func (l *diskCache) filename(name Key) string {
+	return path.Join(l.path, string(name))
+}
+
+// migrate удаляет из каталога кэша временные файлы, оставшиеся от прерванных
+// записей. Файлы со старой схемой именования (ключ как имя файла) и прочие
+// чужие файлы не трогаются: их ключи не совпадут ни с одним новым, а каталог
+// может оказаться общим.
+func migrate(dirname string) error {
+	dir, err := ioutil.ReadDir(dirname)
 	if err != nil {
-		return fmt.Errorf("can't remove file %s:\n %w", filename, err)
+		return fmt.Errorf("can't read directory %s:\n %w", dirname, err)
+	}
+	for _, d := range dir {
+		if d.IsDir() || !tmpNameRe.MatchString(d.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(dirname, d.Name())); err != nil {
+			return fmt.Errorf("can't remove file %s/%s:\n %w", dirname, d.Name(), err)
+		}
 	}
 	return nil
 }
 
-func (l *lruCache) drop() error {
-	dir, err := ioutil.ReadDir(l.path)
+// ownFile сообщает, создан ли файл name кэшем. Чужие файлы в каталоге кэша
+// (например, ключи старого формата) не трогаются.
+func ownFile(name string) bool {
+	return name == indexFile || fileNameRe.MatchString(name) || tmpNameRe.MatchString(name)
+}
+
+func drop(dirname string) error {
+	dir, err := ioutil.ReadDir(dirname)
 	if err != nil {
-		return fmt.Errorf("can't read directory %s:\n %w", l.path, err)
+		return fmt.Errorf("can't read directory %s:\n %w", dirname, err)
 	}
 	for _, d := range dir {
-		if d.Name() != "nofile" {
-			err := os.Remove(path.Join([]string{l.path, d.Name()}...))
+		if !d.IsDir() && ownFile(d.Name()) {
+			err := os.Remove(path.Join([]string{dirname, d.Name()}...))
 			if err != nil {
-				return fmt.Errorf("can't remove file %s/%s:\n %w", l.path, d.Name(), err)
+				return fmt.Errorf("can't remove file %s/%s:\n %w", dirname, d.Name(), err)
 			}
 		}
 	}
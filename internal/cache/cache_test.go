@@ -1,12 +1,16 @@
 package cache
 
 import (
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -16,7 +20,7 @@ func TestCache(t *testing.T) {
 		cacheDir, err := ioutil.TempDir("", "cache_.")
 		require.NoError(t, err, err)
 		defer os.RemoveAll(cacheDir)
-		c, err := NewCache(10, cacheDir)
+		c, err := NewCache(10, 0, cacheDir)
 		require.NoError(t, err, err)
 		err = c.Clear()
 		require.NoError(t, err, err)
@@ -37,7 +41,7 @@ func TestCache(t *testing.T) {
 		cacheDir, err := ioutil.TempDir("", "cache_.")
 		require.NoError(t, err, err)
 		defer os.RemoveAll(cacheDir)
-		c, err := NewCache(5, cacheDir)
+		c, err := NewCache(5, 0, cacheDir)
 		require.NoError(t, err, err)
 		err = c.Clear()
 		require.NoError(t, err, err)
@@ -82,7 +86,7 @@ func TestCache(t *testing.T) {
 		cacheDir, err := ioutil.TempDir("", "cache_.")
 		require.NoError(t, err, err)
 		defer os.RemoveAll(cacheDir)
-		c, err := NewCache(3, cacheDir)
+		c, err := NewCache(3, 0, cacheDir)
 		require.NoError(t, err, err)
 		err = c.Clear()
 		require.NoError(t, err, err)
@@ -124,11 +128,256 @@ func TestCache(t *testing.T) {
 	})
 }
 
+func TestCacheFileNames(t *testing.T) {
+	t.Run("long and unicode keys", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		c, err := NewCache(5, 0, cacheDir)
+		require.NoError(t, err, err)
+
+		long := Key(strings.Repeat("очень/длинный?ключ&", 100))
+		_, err = c.Set(long, []byte("pic #1111"))
+		require.NoError(t, err)
+
+		val, ok, err := c.Get(long)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("pic #1111"), val)
+
+		files, err := ioutil.ReadDir(cacheDir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Regexp(t, fileNameRe, files[0].Name())
+	})
+
+	t.Run("old-style files are ignored", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, "100_100_pic.jpg"), []byte("old"), 0600))
+		require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, "nofile"), []byte{}, 0600))
+		tmp := string(fileKey("aaa")) + ".123456" + tmpExt
+		require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, tmp), []byte("part"), 0600))
+
+		c, err := NewCache(5, 0, cacheDir)
+		require.NoError(t, err, err)
+		_, ok, err := c.Get("100_100_pic.jpg")
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// Удаляются только недописанные файлы самого кэша, в том числе при Clear.
+		names := func() []string {
+			files, err := ioutil.ReadDir(cacheDir)
+			require.NoError(t, err)
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			return names
+		}
+		require.Equal(t, []string{"100_100_pic.jpg", "nofile"}, names())
+		_, err = c.Set("aaa", []byte("aaa"))
+		require.NoError(t, err)
+		require.NoError(t, c.Clear())
+		require.Equal(t, []string{"100_100_pic.jpg", "nofile"}, names())
+	})
+}
+
+func TestCacheEntry(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := NewCache(1, 0, cacheDir)
+	require.NoError(t, err, err)
+
+	now := time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+	e := Entry{Value: []byte("pic"), Meta: Meta{
+		Fetched:      now,
+		Expires:      now.Add(time.Hour),
+		ETag:         `"v1"`,
+		LastModified: "Tue, 01 Dec 2020 09:00:00 GMT",
+	}}
+	_, err = c.Set("aaa", e)
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	val, ok, err := c.Get("aaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	got, ok := val.(Entry)
+	require.True(t, ok)
+	require.Equal(t, e.Value, got.Value)
+	require.True(t, e.Expires.Equal(got.Expires))
+	require.Equal(t, e.ETag, got.ETag)
+	require.Equal(t, e.LastModified, got.LastModified)
+	require.True(t, got.Fresh(now.Add(59*time.Minute)))
+	require.False(t, got.Fresh(now.Add(time.Hour)))
+
+	// Значение без метаданных затирает старые метаданные.
+	_, err = c.Set("aaa", []byte("pic2"))
+	require.NoError(t, err)
+	val, ok, err = c.Get("aaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("pic2"), val)
+
+	// Вытеснение удаляет и файл метаданных.
+	_, err = c.Set("aaa", e)
+	require.NoError(t, err)
+	_, err = c.Set("bbb", []byte("pic3"))
+	require.NoError(t, err)
+	files, err = ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	pic := func(n int) []byte { return []byte(strings.Repeat("x", n)) }
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := NewCache(0, 100, cacheDir)
+	require.NoError(t, err, err)
+	// has проверяет состав кэша, не меняя порядок вытеснения.
+	has := func(keys ...Key) {
+		for _, k := range []Key{"aaa", "bbb", "ccc", "ddd"} {
+			_, ok := c.(*diskCache).items[fileKey(k)]
+			var want bool
+			for _, w := range keys {
+				want = want || w == k
+			}
+			require.Equal(t, want, ok, k)
+		}
+	}
+
+	for _, k := range []Key{"aaa", "bbb", "ccc"} {
+		_, err = c.Set(k, pic(30))
+		require.NoError(t, err)
+	}
+	has("aaa", "bbb", "ccc")
+
+	// Для нового значения вытесняется столько старых, сколько нужно.
+	_, _, err = c.Get("aaa")
+	require.NoError(t, err)
+	_, err = c.Set("ddd", pic(60))
+	require.NoError(t, err)
+	has("aaa", "ddd")
+
+	// Замена значения учитывает только его новый размер.
+	wasInCache, err := c.Set("ddd", pic(70))
+	require.NoError(t, err)
+	require.True(t, wasInCache)
+	has("aaa", "ddd")
+	_, err = c.Set("ddd", pic(80))
+	require.NoError(t, err)
+	has("ddd")
+
+	// Значение больше всего кэша не сохраняется и ничего не вытесняет.
+	_, err = c.Set("aaa", pic(101))
+	require.True(t, errors.Is(err, ErrTooLarge), err)
+	has("ddd")
+	_, err = c.Set("bbb", pic(100))
+	require.NoError(t, err)
+	has("bbb")
+
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	require.Equal(t, int64(100), total)
+}
+
+func TestCacheRestore(t *testing.T) {
+	// fill кладет в кэш aaa, bbb, ccc с убывающей давностью изменения файлов и
+	// обращается к aaa: порядок вытеснения bbb, ccc, aaa.
+	fill := func(t *testing.T, o Options) Cache {
+		c, err := New(o)
+		require.NoError(t, err)
+		now := time.Now()
+		for i, k := range []Key{"aaa", "bbb", "ccc"} {
+			_, err = c.Set(k, Entry{Value: []byte("pic " + string(k)), Meta: Meta{ETag: string(k)}})
+			require.NoError(t, err)
+			mod := now.Add(time.Duration(i-3) * time.Hour)
+			require.NoError(t, os.Chtimes(path.Join(o.Path, string(fileKey(k))), mod, mod))
+		}
+		_, _, err = c.Get("aaa")
+		require.NoError(t, err)
+		return c
+	}
+	check := func(t *testing.T, c Cache, dir string) {
+		_, ok, err := c.Get("bbb")
+		require.NoError(t, err)
+		require.False(t, ok)
+		for _, k := range []Key{"aaa", "ccc"} {
+			val, ok, err := c.Get(k)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, Entry{Value: []byte("pic " + string(k)), Meta: Meta{ETag: string(k)}}, val)
+		}
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 4)
+	}
+
+	t.Run("by modification time", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		c := fill(t, Options{Capacity: 3, Path: cacheDir})
+		require.NoError(t, c.Close())
+		// Метаданные без значения удаляются.
+		require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, string(fileKey("ddd"))+metaExt), []byte("{}"), 0600))
+
+		c, err = New(Options{Capacity: 2, Path: cacheDir})
+		require.NoError(t, err)
+		check(t, c, cacheDir)
+	})
+
+	t.Run("by saved index", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		c := fill(t, Options{Capacity: 3, Path: cacheDir, Index: true})
+		// Время изменения противоречит индексу: порядок должен браться из индекса.
+		old := time.Now().Add(-24 * time.Hour)
+		require.NoError(t, os.Chtimes(path.Join(cacheDir, string(fileKey("aaa"))), old, old))
+		require.NoError(t, c.Close())
+		_, err = os.Stat(path.Join(cacheDir, indexFile))
+		require.NoError(t, err)
+
+		c, err = New(Options{Capacity: 2, MaxBytes: 1000, Path: cacheDir, Index: true})
+		require.NoError(t, err)
+		_, err = os.Stat(path.Join(cacheDir, indexFile))
+		require.True(t, os.IsNotExist(err), "index must be removed after start")
+		meta := `{"Fetched":"0001-01-01T00:00:00Z","Expires":"0001-01-01T00:00:00Z","ETag":"aaa"}`
+		require.Equal(t, int64(2*(len("pic aaa")+len(meta))), c.(*diskCache).size)
+		check(t, c, cacheDir)
+	})
+
+	t.Run("corrupted index", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		c := fill(t, Options{Capacity: 3, Path: cacheDir})
+		require.NoError(t, c.Close())
+		require.NoError(t, ioutil.WriteFile(path.Join(cacheDir, indexFile), []byte("garbage\n"), 0600))
+
+		c, err = New(Options{Capacity: 2, Path: cacheDir, Index: true})
+		require.NoError(t, err)
+		check(t, c, cacheDir)
+	})
+}
+
 func TestCacheMultithreading(t *testing.T) {
 	cacheDir, err := ioutil.TempDir("", "cache_.")
 	require.NoError(t, err, err)
 	defer os.RemoveAll(cacheDir)
-	c, err := NewCache(10, cacheDir)
+	c, err := NewCache(10, 0, cacheDir)
 	require.NoError(t, err, err)
 	err = c.Clear()
 	require.NoError(t, err, err)
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restore восстанавливает очередь вытеснения по файлам names из каталога.
+// Порядок берется из индекса indexed, сохраненного при Close; файлы, которых в
+// нем нет, считаются самыми старыми и упорядочиваются по времени изменения.
+// Значения сверх ограничений сразу вытесняются.
+func (l *diskCache) restore(names []string, indexed []Item) error {
+	files := make(map[string]bool, len(names))
+	for _, n := range names {
+		files[n] = true
+	}
+
+	known := make(map[Key]bool, len(indexed))
+	restored := make([]Item, 0, len(indexed))
+	for _, it := range indexed {
+		if files[string(it.Key)] && !known[it.Key] {
+			known[it.Key] = true
+			restored = append(restored, it)
+		}
+	}
+
+	type unindexed struct {
+		Item
+		mod time.Time
+	}
+	var rest []unindexed
+	for _, n := range names {
+		if !fileNameRe.MatchString(n) {
+			continue
+		}
+		if strings.HasSuffix(n, metaExt) {
+			if !files[strings.TrimSuffix(n, metaExt)] {
+				if err := os.Remove(path.Join(l.path, n)); err != nil {
+					return fmt.Errorf("can't remove file %s/%s:\n %w", l.path, n, err)
+				}
+			}
+			continue
+		}
+		if known[Key(n)] {
+			continue
+		}
+		fi, err := os.Stat(l.filename(Key(n)))
+		if err != nil {
+			return fmt.Errorf("can't stat file %s/%s:\n %w", l.path, n, err)
+		}
+		u := unindexed{Item{Key: Key(n), Size: fi.Size()}, fi.ModTime()}
+		if files[n+metaExt] {
+			if mi, err := os.Stat(l.filename(Key(n)) + metaExt); err == nil {
+				u.Size += mi.Size()
+			}
+		}
+		rest = append(rest, u)
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].mod.Before(rest[j].mod) })
+
+	for _, u := range rest {
+		l.items[u.Key] = u.Item
+		l.policy.add(u.Key)
+		l.size += u.Size
+	}
+	for _, it := range restored {
+		l.items[it.Key] = it
+		l.policy.add(it.Key)
+		l.size += it.Size
+	}
+	return l.evict("", 0, 0)
+}
+
+// readNames возвращает имена файлов каталога, не читая их атрибутов.
+func readNames(dirname string) ([]string, error) {
+	d, err := os.Open(dirname)
+	if err != nil {
+		return nil, fmt.Errorf("can't open directory %s:\n %w", dirname, err)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s:\n %w", dirname, err)
+	}
+	return names, nil
+}
+
+// readIndex читает индекс, сохраненный при Close, и удаляет его: после сбоя
+// устаревший индекс не должен использоваться. Без индекса возвращает nil.
+func readIndex(dirname string) ([]Item, error) {
+	filename := path.Join(dirname, indexFile)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read file %s:\n %w", filename, err)
+	}
+	if err = os.Remove(filename); err != nil {
+		return nil, fmt.Errorf("can't remove file %s:\n %w", filename, err)
+	}
+	var items []Item
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 || !fileNameRe.MatchString(f[0]) || strings.HasSuffix(f[0], metaExt) {
+			log.Printf("cache index %s is corrupted, ignore it.\n", filename)
+			return nil, nil
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil || size < 0 {
+			log.Printf("cache index %s is corrupted, ignore it.\n", filename)
+			return nil, nil
+		}
+		items = append(items, Item{Key: Key(f[0]), Size: size})
+	}
+	return items, nil
+}
+
+// writeIndex атомарно сохраняет индекс из строк, подготовленных appendIndex.
+func writeIndex(dirname string, index []byte) error {
+	filename := path.Join(dirname, indexFile)
+	if err := ioutil.WriteFile(filename+tmpExt, index, 0600); err != nil {
+		return fmt.Errorf("can't write file %s:\n %w", filename+tmpExt, err)
+	}
+	if err := os.Rename(filename+tmpExt, filename); err != nil {
+		return fmt.Errorf("can't rename file %s:\n %w", filename+tmpExt, err)
+	}
+	return nil
+}
+
+// appendIndex дописывает к b строки индекса - имя файла и размер значения, от
+// первых кандидатов на вытеснение к последним. Вызывается под блокировкой.
+func (l *diskCache) appendIndex(b []byte) ([]byte, error) {
+	for _, name := range l.policy.order() {
+		it, ok := l.items[name]
+		if !ok {
+			return nil, fmt.Errorf("eviction policy has unknown item %s", name)
+		}
+		b = append(b, it.Key...)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, it.Size, 10)
+		b = append(b, '\n')
+	}
+	return b, nil
+}
+
+// Close сохраняет индекс, если это включено в Options.
+func (l *diskCache) Close() error {
+	if !l.index {
+		return nil
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	b, err := l.appendIndex(nil)
+	if err != nil {
+		return err
+	}
+	return writeIndex(l.path, b)
+}
+
+// shardOf возвращает номер шарда из n, которому принадлежит файл name.
+func shardOf(name string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h, _ := strconv.ParseUint(name[:8], 16, 32)
+	return int(h % uint64(n))
+}
+
+// ownNames отбирает файлы кэша, принадлежащие шарду i из n.
+func ownNames(names []string, i, n int) []string {
+	var own []string
+	for _, name := range names {
+		if fileNameRe.MatchString(name) && shardOf(name, n) == i {
+			own = append(own, name)
+		}
+	}
+	return own
+}
+
+// ownItems отбирает строки индекса, принадлежащие шарду i из n.
+func ownItems(items []Item, i, n int) []Item {
+	var own []Item
+	for _, it := range items {
+		if shardOf(string(it.Key), n) == i {
+			own = append(own, it)
+		}
+	}
+	return own
+}
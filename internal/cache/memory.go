@@ -0,0 +1,56 @@
+package cache
+
+// memCache - LRU в памяти, ограниченный суммарным размером значений. Не
+// потокобезопасен: синхронизацию обеспечивает tieredCache.
+type memCache struct {
+	maxBytes int64
+	size     int64
+	queue    *List
+	items    map[Key]*ListItem
+}
+
+func newMemCache(maxBytes int64) *memCache {
+	return &memCache{maxBytes: maxBytes, queue: NewList(), items: make(map[Key]*ListItem)}
+}
+
+func (m *memCache) get(key Key) (interface{}, bool) {
+	i, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.queue.MoveToFront(i)
+	return i.Value.(Item).Value, true
+}
+
+func (m *memCache) has(key Key) bool {
+	_, ok := m.items[key]
+	return ok
+}
+
+// add кладет значение в начало очереди, вытесняя старые значения. Значение
+// больше всего кэша не сохраняется.
+func (m *memCache) add(key Key, value interface{}, size int64) {
+	m.remove(key)
+	if size > m.maxBytes {
+		return
+	}
+	for m.queue.Len() > 0 && m.size+size > m.maxBytes {
+		m.remove(m.queue.Back().Value.(Item).Key)
+	}
+	m.items[key] = m.queue.PushFront(Item{Key: key, Value: value, Size: size})
+	m.size += size
+}
+
+func (m *memCache) remove(key Key) {
+	if i, ok := m.items[key]; ok {
+		m.size -= i.Value.(Item).Size
+		m.queue.Remove(i)
+		delete(m.items, key)
+	}
+}
+
+func (m *memCache) clear() {
+	m.size = 0
+	m.queue = NewList()
+	m.items = make(map[Key]*ListItem)
+}
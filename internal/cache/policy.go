@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+)
+
+// policy решает, какие значения вытеснять из diskCache. Не потокобезопасна:
+// вызывается под блокировкой кэша.
+type policy interface {
+	add(name Key)                     // значение сохранено
+	access(name Key)                  // обращение к сохраненному значению
+	remove(name Key, evicted bool)    // значение удалено; evicted - вытеснено ради нового
+	victim(candidate Key) (Key, bool) // кого вытеснить ради candidate
+	order() []Key                     // от первых кандидатов на вытеснение к последним
+}
+
+// admission решает, стоит ли новое значение вытеснения старого.
+type admission interface {
+	record(name Key) // обращение к значению, в том числе к отсутствующему
+	admit(candidate, victim Key) bool
+}
+
+// newPolicy создает политику вытеснения по имени из Options.Policy.
+func newPolicy(name string) (func() policy, error) {
+	switch name {
+	case "", "lru":
+		return func() policy { return newLRUPolicy() }, nil
+	case "lfu":
+		return func() policy { return newLFUPolicy() }, nil
+	case "arc":
+		return func() policy { return newARCPolicy() }, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// newAdmission создает фильтр допуска по имени из Options.Admission для шарда
+// из capacity значений (0 - без ограничения числа).
+func newAdmission(name string, capacity int) (func() admission, error) {
+	switch name {
+	case "":
+		return func() admission { return nil }, nil
+	case "tinylfu":
+		return func() admission { return newTinyLFU(capacity) }, nil
+	}
+	return nil, fmt.Errorf("unknown admission policy %q", name)
+}
+
+// lruPolicy вытесняет давно использованные значения.
+type lruPolicy struct {
+	queue *List
+	items map[Key]*ListItem
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{queue: NewList(), items: make(map[Key]*ListItem)}
+}
+
+func (p *lruPolicy) add(name Key) {
+	p.items[name] = p.queue.PushFront(name)
+}
+
+func (p *lruPolicy) access(name Key) {
+	if i, ok := p.items[name]; ok {
+		p.queue.MoveToFront(i)
+	}
+}
+
+func (p *lruPolicy) remove(name Key, _ bool) {
+	if i, ok := p.items[name]; ok {
+		p.queue.Remove(i)
+		delete(p.items, name)
+	}
+}
+
+func (p *lruPolicy) victim(Key) (Key, bool) {
+	if p.queue.Len() == 0 {
+		return "", false
+	}
+	return p.queue.Back().Value.(Key), true
+}
+
+func (p *lruPolicy) order() []Key {
+	return listKeys(p.queue)
+}
+
+// listKeys возвращает ключи списка от конца к началу.
+func listKeys(l *List) []Key {
+	keys := make([]Key, 0, l.Len())
+	for i := l.Back(); i != nil; i = i.Next {
+		keys = append(keys, i.Value.(Key))
+	}
+	return keys
+}
+
+// lfuPolicy вытесняет реже всего использованные значения, из равных - давно
+// использованные.
+type lfuPolicy struct {
+	heap  lfuHeap
+	items map[Key]*lfuEntry
+	tick  uint64
+}
+
+type lfuEntry struct {
+	name  Key
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[Key]*lfuEntry)}
+}
+
+func (p *lfuPolicy) add(name Key) {
+	p.tick++
+	e := &lfuEntry{name: name, freq: 1, tick: p.tick}
+	p.items[name] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *lfuPolicy) access(name Key) {
+	if e, ok := p.items[name]; ok {
+		p.tick++
+		e.freq++
+		e.tick = p.tick
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) remove(name Key, _ bool) {
+	if e, ok := p.items[name]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.items, name)
+	}
+}
+
+func (p *lfuPolicy) victim(Key) (Key, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].name, true
+}
+
+func (p *lfuPolicy) order() []Key {
+	h := make(lfuHeap, len(p.heap))
+	for i, e := range p.heap {
+		c := *e
+		h[i] = &c
+	}
+	keys := make([]Key, 0, len(h))
+	for h.Len() > 0 {
+		keys = append(keys, heap.Pop(&h).(*lfuEntry).name)
+	}
+	return keys
+}
+
+// arcPolicy - Adaptive Replacement Cache: значения, использованные однажды
+// (t1), и повторно (t2), делят кэш в пропорции, которая подстраивается по
+// промахам на недавно вытесненные значения (b1, b2). Размер кэша c берется
+// по текущему числу значений, поэтому политика работает и при ограничении
+// только по байтам.
+type arcPolicy struct {
+	t1, t2, b1, b2 *List
+	items          map[Key]*arcEntry
+	p              int // целевой размер t1
+}
+
+type arcEntry struct {
+	list *List
+	item *ListItem
+}
+
+func newARCPolicy() *arcPolicy {
+	return &arcPolicy{t1: NewList(), t2: NewList(), b1: NewList(), b2: NewList(), items: make(map[Key]*arcEntry)}
+}
+
+func (p *arcPolicy) move(name Key, to *List) {
+	if e, ok := p.items[name]; ok {
+		e.list.Remove(e.item)
+	}
+	p.items[name] = &arcEntry{list: to, item: to.PushFront(name)}
+}
+
+func (p *arcPolicy) drop(l *List) {
+	name := l.Back().Value.(Key)
+	l.Remove(l.Back())
+	delete(p.items, name)
+}
+
+func (p *arcPolicy) add(name Key) {
+	e, ok := p.items[name]
+	switch {
+	case ok && e.list == p.b1:
+		p.p = minInt(p.p+maxInt(p.b2.Len()/maxInt(p.b1.Len(), 1), 1), p.size())
+		p.move(name, p.t2)
+	case ok && e.list == p.b2:
+		p.p = maxInt(p.p-maxInt(p.b1.Len()/maxInt(p.b2.Len(), 1), 1), 0)
+		p.move(name, p.t2)
+	default:
+		p.move(name, p.t1)
+	}
+	c := p.size()
+	for p.b1.Len() > 0 && p.t1.Len()+p.b1.Len() > c {
+		p.drop(p.b1)
+	}
+	for p.b2.Len() > 0 && p.t1.Len()+p.t2.Len()+p.b1.Len()+p.b2.Len() > 2*c {
+		p.drop(p.b2)
+	}
+}
+
+func (p *arcPolicy) access(name Key) {
+	if e, ok := p.items[name]; ok && (e.list == p.t1 || e.list == p.t2) {
+		p.move(name, p.t2)
+	}
+}
+
+func (p *arcPolicy) remove(name Key, evicted bool) {
+	e, ok := p.items[name]
+	if !ok || (e.list != p.t1 && e.list != p.t2) {
+		return
+	}
+	switch {
+	case !evicted:
+		e.list.Remove(e.item)
+		delete(p.items, name)
+	case e.list == p.t1:
+		p.move(name, p.b1)
+	default:
+		p.move(name, p.b2)
+	}
+}
+
+func (p *arcPolicy) victim(candidate Key) (Key, bool) {
+	e, inB2 := p.items[candidate]
+	inB2 = inB2 && e.list == p.b2
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || (inB2 && p.t1.Len() == p.p) || p.t2.Len() == 0) {
+		return p.t1.Back().Value.(Key), true
+	}
+	if p.t2.Len() > 0 {
+		return p.t2.Back().Value.(Key), true
+	}
+	return "", false
+}
+
+func (p *arcPolicy) order() []Key {
+	if p.t1.Len() > p.p {
+		return append(listKeys(p.t1), listKeys(p.t2)...)
+	}
+	return append(listKeys(p.t2), listKeys(p.t1)...)
+}
+
+// size - текущий размер кэша в значениях.
+func (p *arcPolicy) size() int {
+	return maxInt(p.t1.Len()+p.t2.Len(), 1)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// tinyLFU пускает новое значение, только если к нему обращались чаще, чем к
+// вытесняемому. Частоты приближенно считает count-min sketch с 4-битными
+// счетчиками, которые периодически уполовиниваются, чтобы старая популярность
+// забывалась.
+type tinyLFU struct {
+	counters []uint8 // по два счетчика в байте
+	mask     uint64
+	added    int
+	resetAt  int
+}
+
+const tinyLFUDepth = 4
+
+func newTinyLFU(capacity int) *tinyLFU {
+	width := 1 << 10
+	for width < capacity*8 {
+		width <<= 1
+	}
+	return &tinyLFU{
+		counters: make([]uint8, tinyLFUDepth*width/2),
+		mask:     uint64(width - 1),
+		resetAt:  width * 10,
+	}
+}
+
+// index возвращает номер счетчика name в строке row.
+func (f *tinyLFU) index(h uint64, row int) uint64 {
+	h1, h2 := h, h>>32|h<<32
+	return uint64(row)*(f.mask+1) + (h1+uint64(row)*h2)&f.mask
+}
+
+func (f *tinyLFU) get(i uint64) uint8 {
+	return f.counters[i/2] >> (4 * (i % 2)) & 0x0f
+}
+
+func (f *tinyLFU) record(name Key) {
+	h := hashKey(name)
+	for row := 0; row < tinyLFUDepth; row++ {
+		i := f.index(h, row)
+		if f.get(i) < 15 {
+			f.counters[i/2] += 1 << (4 * (i % 2))
+		}
+	}
+	f.added++
+	if f.added >= f.resetAt {
+		for i, c := range f.counters {
+			f.counters[i] = c >> 1 & 0x77
+		}
+		f.added /= 2
+	}
+}
+
+func (f *tinyLFU) estimate(name Key) uint8 {
+	h := hashKey(name)
+	min := uint8(15)
+	for row := 0; row < tinyLFUDepth; row++ {
+		if c := f.get(f.index(h, row)); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (f *tinyLFU) admit(candidate, victim Key) bool {
+	return f.estimate(candidate) > f.estimate(victim)
+}
+
+func hashKey(name Key) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum64()
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	table := []struct {
+		name   string
+		policy string
+		// После add a, b, c и обращения к a дважды, а к b - однажды.
+		victim Key
+		order  []Key
+	}{
+		{name: "lru", policy: "lru", victim: "c", order: []Key{"c", "b", "a"}},
+		{name: "default is lru", policy: "", victim: "c", order: []Key{"c", "b", "a"}},
+		{name: "lfu", policy: "lfu", victim: "c", order: []Key{"c", "b", "a"}},
+		{name: "arc", policy: "arc", victim: "c", order: []Key{"c", "b", "a"}},
+	}
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			newP, err := newPolicy(tt.policy)
+			require.NoError(t, err)
+			p := newP()
+			for _, k := range []Key{"a", "b", "c"} {
+				p.add(k)
+			}
+			p.access("a")
+			p.access("b")
+			p.access("a")
+			v, ok := p.victim("d")
+			require.True(t, ok)
+			require.Equal(t, tt.victim, v)
+			require.Equal(t, tt.order, p.order())
+
+			p.remove(v, true)
+			p.remove("a", false)
+			require.Equal(t, []Key{"b"}, p.order())
+			p.remove("b", true)
+			_, ok = p.victim("d")
+			require.False(t, ok)
+			require.Empty(t, p.order())
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := newPolicy("fifo")
+		require.Error(t, err)
+		_, err = newAdmission("bloom", 10)
+		require.Error(t, err)
+		cacheDir, err := ioutil.TempDir("", "cache_.")
+		require.NoError(t, err, err)
+		defer os.RemoveAll(cacheDir)
+		_, err = New(Options{Path: cacheDir, Policy: "fifo"})
+		require.Error(t, err)
+	})
+}
+
+func TestPolicyLFU(t *testing.T) {
+	// Частое значение переживает поток новых, как бы давно к нему ни обращались.
+	p := newLFUPolicy()
+	p.add("hot")
+	p.access("hot")
+	for i := 0; i < 10; i++ {
+		k := Key(strconv.Itoa(i))
+		p.add(k)
+		v, ok := p.victim("")
+		require.True(t, ok)
+		require.Equal(t, k, v)
+		p.remove(v, true)
+	}
+	require.Equal(t, []Key{"hot"}, p.order())
+}
+
+func TestPolicyARC(t *testing.T) {
+	p := newARCPolicy()
+	for _, k := range []Key{"a", "b"} {
+		p.add(k)
+	}
+	p.access("a")
+	// Использованное однажды b вытесняется первым и запоминается в b1.
+	v, ok := p.victim("c")
+	require.True(t, ok)
+	require.Equal(t, Key("b"), v)
+	p.remove(v, true)
+	p.add("c")
+	require.Equal(t, p.b1, p.items["b"].list)
+
+	// Промах на b из b1 увеличивает долю недавних значений, b сразу попадает в t2.
+	v, _ = p.victim("b")
+	p.remove(v, true)
+	p.add("b")
+	require.Equal(t, 1, p.p)
+	require.Equal(t, p.t2, p.items["b"].list)
+}
+
+func TestTinyLFU(t *testing.T) {
+	f := newTinyLFU(10)
+	for i := 0; i < 5; i++ {
+		f.record("hot")
+	}
+	f.record("once")
+	require.Equal(t, uint8(5), f.estimate("hot"))
+	require.False(t, f.admit("once", "hot"))
+	require.True(t, f.admit("hot", "once"))
+	require.False(t, f.admit("never", "once"))
+
+	// Счетчики насыщаются на 15 и уполовиниваются раз в resetAt записей.
+	for i := 0; i < 20; i++ {
+		f.record("hot")
+	}
+	require.Equal(t, uint8(15), f.estimate("hot"))
+	for prev := -1; f.added > prev; {
+		prev = f.added
+		f.record("other")
+	}
+	require.Equal(t, uint8(7), f.estimate("hot"))
+}
+
+func TestCacheAdmission(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := New(Options{Capacity: 2, Path: cacheDir, Admission: "tinylfu"})
+	require.NoError(t, err)
+	for _, k := range []Key{"aaa", "bbb"} {
+		_, err = c.Set(k, []byte(k))
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, _, err = c.Get(k)
+			require.NoError(t, err)
+		}
+	}
+
+	// Новое значение реже вытесняемого не попадает в кэш.
+	_, err = c.Set("ccc", []byte("ccc"))
+	require.NoError(t, err)
+	_, ok, err := c.Get("ccc")
+	require.NoError(t, err)
+	require.False(t, ok)
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// Набрав обращений, оно вытесняет старое.
+	for i := 0; i < 5; i++ {
+		_, _, err = c.Get("ccc")
+		require.NoError(t, err)
+	}
+	_, err = c.Set("ccc", []byte("ccc"))
+	require.NoError(t, err)
+	v, ok, err := c.Get("ccc")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("ccc"), v)
+
+	// Замена существующего значения не проходит через фильтр.
+	_, err = c.Set("ccc", []byte("new"))
+	require.NoError(t, err)
+	v, _, err = c.Get("ccc")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), v)
+}
+
+// trace - обращения к превью: популярные по закону Zipf вперемешку с
+// последовательными проходами по значениям, которые больше не запрашиваются.
+func trace(n int) []Key {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 9999)
+	keys := make([]Key, 0, n)
+	scan := 0
+	for len(keys) < n {
+		if r.Intn(10) == 0 {
+			for i := 0; i < 50; i++ {
+				keys = append(keys, Key("scan"+strconv.Itoa(scan)))
+				scan++
+			}
+			continue
+		}
+		keys = append(keys, Key(strconv.FormatUint(zipf.Uint64(), 10)))
+	}
+	return keys[:n]
+}
+
+// hitRatio проигрывает trace через кэш так же, как обработчик: Get и Set при
+// промахе.
+func hitRatio(t *testing.T, o Options, keys []Key) float64 {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	o.Path = cacheDir
+	c, err := New(o)
+	require.NoError(t, err)
+	var hits int
+	for _, k := range keys {
+		_, ok, err := c.Get(k)
+		require.NoError(t, err)
+		if ok {
+			hits++
+			continue
+		}
+		_, err = c.Set(k, []byte("x"))
+		require.NoError(t, err)
+	}
+	return float64(hits) / float64(len(keys))
+}
+
+func TestPolicyTraceReplaySlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	keys := trace(10000)
+	lru := hitRatio(t, Options{Capacity: 200}, keys)
+	table := []struct {
+		name      string
+		policy    string
+		admission string
+	}{
+		{name: "lfu", policy: "lfu"},
+		{name: "arc", policy: "arc"},
+		{name: "lru+tinylfu", policy: "lru", admission: "tinylfu"},
+		{name: "lfu+tinylfu", policy: "lfu", admission: "tinylfu"},
+		{name: "arc+tinylfu", policy: "arc", admission: "tinylfu"},
+	}
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			ratio := hitRatio(t, Options{Capacity: 200, Policy: tt.policy, Admission: tt.admission}, keys)
+			t.Logf("hit ratio %.3f, lru %.3f", ratio, lru)
+			require.Greater(t, ratio, lru)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Поля хэша redis, в котором хранится значение.
+const (
+	redisValue = "v"
+	redisMeta  = "m"
+)
+
+// redisCache хранит значения в redis, общем для нескольких экземпляров
+// сервиса. Значение и метаданные лежат в одном хэше, вытеснение и общий
+// объем - забота самого redis (maxmemory-policy).
+type redisCache struct {
+	client   *redis.Client
+	prefix   string
+	ttl      time.Duration
+	maxBytes int64
+}
+
+func newRedisCache(o Options) (Cache, error) {
+	client := redis.NewClient(&redis.Options{Addr: o.RedisAddr, Password: o.RedisPassword, DB: o.RedisDB})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("can't connect to redis %s:\n %w", o.RedisAddr, err)
+	}
+	return &redisCache{client: client, prefix: o.Prefix, ttl: o.TTL, maxBytes: o.MaxValueBytes}, nil
+}
+
+func (r *redisCache) key(key Key) string {
+	return r.prefix + string(fileKey(key))
+}
+
+func (r *redisCache) Set(key Key, value interface{}) (bool, error) {
+	data, meta, err := encode(value)
+	if err != nil {
+		return false, err
+	}
+	if r.maxBytes > 0 && int64(len(data)+len(meta)) > r.maxBytes {
+		return false, ErrTooLarge
+	}
+	ttl := r.ttl
+	if e, ok := value.(Entry); ok && !e.Expires.IsZero() {
+		keep := e.StaleWhileRevalidate
+		if e.StaleIfError > keep {
+			keep = e.StaleIfError
+		}
+		ttl = time.Until(e.Expires.Add(keep))
+	}
+	ctx := context.Background()
+	name := r.key(key)
+	var exists *redis.IntCmd
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Del(ctx, name)
+		if ttl < 0 {
+			// Запись уже нельзя отдать: хранить ее незачем.
+			return nil
+		}
+		fields := []interface{}{redisValue, data}
+		if meta != nil {
+			fields = append(fields, redisMeta, meta)
+		}
+		pipe.HSet(ctx, name, fields...)
+		if ttl > 0 {
+			pipe.PExpire(ctx, name, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("can't save key %s to redis:\n %w", name, err)
+	}
+	return exists.Val() > 0, nil
+}
+
+func (r *redisCache) Get(key Key) (interface{}, bool, error) {
+	name := r.key(key)
+	fields, err := r.client.HMGet(context.Background(), name, redisValue, redisMeta).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("can't read key %s from redis:\n %w", name, err)
+	}
+	data, ok := fields[0].(string)
+	if !ok {
+		return nil, false, nil
+	}
+	meta, ok := fields[1].(string)
+	if !ok {
+		return []byte(data), true, nil
+	}
+	e := Entry{Value: []byte(data)}
+	if err = json.Unmarshal([]byte(meta), &e.Meta); err != nil {
+		return nil, false, fmt.Errorf("can't unmarshal metadata from %s:\n %w", name, err)
+	}
+	return e, true, nil
+}
+
+// Clear удаляет из redis все значения с префиксом кэша, не трогая чужие ключи.
+func (r *redisCache) Clear() error {
+	ctx := context.Background()
+	match := redisPattern(r.prefix) + strings.Repeat("[0-9a-f]", 64)
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, match, 1000).Result()
+		if err != nil {
+			return fmt.Errorf("can't scan redis keys %s:\n %w", match, err)
+		}
+		if len(keys) > 0 {
+			if err = r.client.Del(ctx, keys...).Err(); err != nil {
+				return fmt.Errorf("can't delete redis keys:\n %w", err)
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *redisCache) Close() error {
+	return r.client.Close()
+}
+
+// redisPattern экранирует спецсимволы шаблона SCAN MATCH.
+func redisPattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\^-`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
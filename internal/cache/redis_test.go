@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedis(t *testing.T, o Options) (Cache, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+	o.Backend = "redis"
+	o.RedisAddr = m.Addr()
+	c, err := New(o)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c, m
+}
+
+func TestRedisCache(t *testing.T) {
+	c, m := newRedis(t, Options{Prefix: "previewer:", TTL: time.Hour})
+
+	_, ok, err := c.Get("aaa")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Двоичное значение без метаданных живет TTL.
+	pic := []byte{0, 1, 0xff, 0xfe}
+	exists, err := c.Set("aaa", pic)
+	require.NoError(t, err)
+	require.False(t, exists)
+	v, ok, err := c.Get("aaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, pic, v)
+	name := "previewer:" + string(fileKey("aaa"))
+	require.True(t, m.Exists(name))
+	require.Equal(t, time.Hour, m.TTL(name))
+
+	// Запись с метаданными живет, пока ее можно отдать, а замена убирает
+	// метаданные прежней.
+	now := time.Now().UTC().Truncate(time.Second)
+	e := Entry{Value: []byte("new"), Meta: Meta{Fetched: now, Expires: now.Add(time.Minute), ETag: "v2", StaleIfError: time.Hour}}
+	exists, err = c.Set("aaa", e)
+	require.NoError(t, err)
+	require.True(t, exists)
+	v, _, err = c.Get("aaa")
+	require.NoError(t, err)
+	require.Equal(t, e, v)
+	require.InDelta(t, float64(time.Hour+time.Minute), float64(m.TTL(name)), float64(2*time.Second))
+	_, err = c.Set("aaa", pic)
+	require.NoError(t, err)
+	v, _, err = c.Get("aaa")
+	require.NoError(t, err)
+	require.Equal(t, pic, v)
+
+	m.FastForward(time.Hour + time.Second)
+	_, ok, err = c.Get("aaa")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Запись, которую уже нельзя отдать, не сохраняется.
+	e.Expires = now.Add(-2 * time.Hour)
+	_, err = c.Set("bbb", e)
+	require.NoError(t, err)
+	_, ok, err = c.Get("bbb")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRedisCacheLimits(t *testing.T) {
+	c, m := newRedis(t, Options{Prefix: "a*", MaxValueBytes: 10})
+	_, err := c.Set("big", []byte("0123456789a"))
+	require.True(t, errors.Is(err, ErrTooLarge), err)
+	_, err = c.Set("aaa", []byte("0123456789"))
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), m.TTL("a*"+string(fileKey("aaa"))))
+	_, err = c.Set("xxx", 1)
+	require.Error(t, err)
+
+	// Clear удаляет только ключи своего префикса.
+	require.NoError(t, m.Set("a*other", "x"))
+	require.NoError(t, m.Set("ab"+string(fileKey("aaa")), "x"))
+	require.NoError(t, c.Clear())
+	_, ok, err := c.Get("aaa")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.ElementsMatch(t, []string{"a*other", "ab" + string(fileKey("aaa"))}, m.Keys())
+}
+
+func TestRedisCacheShared(t *testing.T) {
+	// Экземпляры с общим redis видят значения друг друга, если не делят его
+	// префиксами.
+	a, m := newRedis(t, Options{Prefix: "p:", MemoryBytes: 100})
+	b, err := New(Options{Backend: "redis", RedisAddr: m.Addr(), Prefix: "p:"})
+	require.NoError(t, err)
+	defer b.Close()
+	other, err := New(Options{Backend: "redis", RedisAddr: m.Addr(), Prefix: "q:"})
+	require.NoError(t, err)
+	defer other.Close()
+
+	_, err = a.Set("aaa", []byte("aaa"))
+	require.NoError(t, err)
+	v, ok, err := b.Get("aaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("aaa"), v)
+	_, ok, err = other.Get("aaa")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, int64(0), a.(*tieredCache).Stats().DiskHits)
+
+	addr := m.Addr()
+	m.Close()
+	_, _, err = b.Get("aaa")
+	require.Error(t, err)
+	_, err = New(Options{Backend: "redis", RedisAddr: addr})
+	require.Error(t, err)
+	_, err = New(Options{Backend: "memcached"})
+	require.Error(t, err)
+}
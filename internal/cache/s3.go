@@ -0,0 +1,354 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3Meta - заголовок объекта с метаданными Entry (JSON в base64).
+	s3Meta = "X-Amz-Meta-Preview"
+	// s3Timeout - предел одного запроса к хранилищу.
+	s3Timeout = 30 * time.Second
+)
+
+// s3Cache хранит значения объектами в бакете S3-совместимого хранилища под
+// ключами Prefix + sha256 от ключа кэша. Срок хранения объектов задается
+// правилами жизненного цикла бакета.
+type s3Cache struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	maxBytes  int64
+	now       func() time.Time
+}
+
+func newS3Cache(o Options) (*s3Cache, error) {
+	endpoint, err := url.Parse(o.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("bad s3 endpoint %q", o.S3Endpoint)
+	}
+	if o.S3Bucket == "" {
+		return nil, errors.New("s3 bucket is not set")
+	}
+	region := o.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Cache{
+		client:    &http.Client{Timeout: s3Timeout},
+		endpoint:  endpoint,
+		bucket:    o.S3Bucket,
+		prefix:    o.Prefix,
+		region:    region,
+		accessKey: o.S3AccessKey,
+		secretKey: o.S3SecretKey,
+		maxBytes:  o.MaxValueBytes,
+		now:       time.Now,
+	}, nil
+}
+
+// newS3Backend создает кэш в S3 с дисковым кэшем в каталоге Path перед ним.
+func newS3Backend(o Options) (Cache, error) {
+	remote, err := newS3Cache(o)
+	if err != nil {
+		return nil, err
+	}
+	local, err := newDiskCache(o)
+	if err != nil {
+		return nil, err
+	}
+	return &frontCache{local: local, remote: remote}, nil
+}
+
+// Set записывает объект одним PUT и всегда возвращает false: проверка HEAD
+// стоила бы лишнего запроса, а без права ListBucket S3 отвечает на нее 403.
+func (s *s3Cache) Set(key Key, value interface{}) (bool, error) {
+	data, meta, err := encode(value)
+	if err != nil {
+		return false, err
+	}
+	if s.maxBytes > 0 && int64(len(data)+len(meta)) > s.maxBytes {
+		return false, ErrTooLarge
+	}
+	name := s.prefix + string(fileKey(key))
+	h := http.Header{"Content-Type": {"application/octet-stream"}}
+	if meta != nil {
+		h.Set(s3Meta, base64.StdEncoding.EncodeToString(meta))
+	}
+	resp, err := s.do(http.MethodPut, name, nil, h, data)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("can't put object %s:\n %s", name, resp.Status)
+	}
+	return false, nil
+}
+
+func (s *s3Cache) Get(key Key) (interface{}, bool, error) {
+	name := s.prefix + string(fileKey(key))
+	resp, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("can't get object %s:\n %s", name, resp.Status)
+	}
+	meta := resp.Header.Get(s3Meta)
+	if meta == "" {
+		return resp.body, true, nil
+	}
+	e := Entry{Value: resp.body}
+	b, err := base64.StdEncoding.DecodeString(meta)
+	if err == nil {
+		err = json.Unmarshal(b, &e.Meta)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("can't unmarshal metadata of object %s:\n %w", name, err)
+	}
+	return e, true, nil
+}
+
+// Clear удаляет объекты с префиксом кэша, не трогая остальные объекты бакета.
+func (s *s3Cache) Clear() error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("can't list objects %s:\n %s", s.prefix, resp.Status)
+		}
+		var list struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = xml.Unmarshal(resp.body, &list); err != nil {
+			return fmt.Errorf("can't unmarshal objects list:\n %w", err)
+		}
+		for _, o := range list.Contents {
+			if !fileNameRe.MatchString(strings.TrimPrefix(o.Key, s.prefix)) {
+				continue
+			}
+			if resp, err = s.do(http.MethodDelete, o.Key, nil, nil, nil); err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("can't delete object %s:\n %s", o.Key, resp.Status)
+			}
+		}
+		if !list.IsTruncated {
+			return nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (s *s3Cache) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// s3Response - ответ хранилища с прочитанным телом.
+type s3Response struct {
+	*http.Response
+	body []byte
+}
+
+// do выполняет подписанный запрос к объекту name бакета (к самому бакету при
+// пустом name).
+func (s *s3Cache) do(method, name string, q url.Values, h http.Header, body []byte) (*s3Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("can't create request to %s:\n %w", u.String(), err)
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.accessKey, s.secretKey, s.region, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't %s %s:\n %w", method, u.String(), err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read response of %s %s:\n %w", method, u.String(), err)
+	}
+	return &s3Response{Response: resp, body: b}, nil
+}
+
+// signV4 подписывает запрос к S3 по AWS Signature Version 4. Подписываются
+// Host и все заголовки, уже выставленные в req.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.EscapedPath(), false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = io.WriteString(h, s)
+	return h.Sum(nil)
+}
+
+// canonicalQuery - параметры запроса, отсортированные и закодированные по
+// правилам SigV4.
+func canonicalQuery(q url.Values) string {
+	pairs := make([]string, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode кодирует все, кроме незарезервированных символов RFC 3986 и, при
+// !slash, символа "/". Уже закодированный путь сначала раскодируется.
+func uriEncode(s string, slash bool) string {
+	if !slash {
+		if u, err := url.PathUnescape(s); err == nil {
+			s = u
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// frontCache - дисковый кэш перед удаленным хранилищем. Запись сквозная,
+// найденное только в хранилище сохраняется на диск. Признак "значение уже было"
+// берется с диска.
+type frontCache struct {
+	local  Cache
+	remote Cache
+}
+
+func (f *frontCache) Set(key Key, value interface{}) (bool, error) {
+	if _, err := f.remote.Set(key, value); err != nil {
+		return false, err
+	}
+	exists, err := f.local.Set(key, value)
+	if err != nil && !errors.Is(err, ErrTooLarge) {
+		return exists, err
+	}
+	return exists, nil
+}
+
+func (f *frontCache) Get(key Key) (interface{}, bool, error) {
+	if v, ok, err := f.local.Get(key); err != nil || ok {
+		return v, ok, err
+	}
+	v, ok, err := f.remote.Get(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	// Ошибка не критична: значение прочитается из хранилища снова.
+	_, _ = f.local.Set(key, v)
+	return v, true, nil
+}
+
+func (f *frontCache) touch(key Key) {
+	if t, ok := f.local.(toucher); ok {
+		t.touch(key)
+	}
+}
+
+func (f *frontCache) Clear() error {
+	if err := f.remote.Clear(); err != nil {
+		return err
+	}
+	return f.local.Clear()
+}
+
+func (f *frontCache) Close() error {
+	err := f.local.Close()
+	if rerr := f.remote.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
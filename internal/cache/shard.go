@@ -0,0 +1,65 @@
+package cache
+
+import "fmt"
+
+// shardedCache распределяет значения между независимыми шардами по хэшу ключа,
+// чтобы запросы к разным значениям не ждали друг друга. Все шарды хранят
+// файлы в одном каталоге; каждый ограничен своей долей Capacity и MaxBytes.
+type shardedCache struct {
+	shards []*diskCache
+	index  bool
+}
+
+func (s *shardedCache) shard(name Key) *diskCache {
+	return s.shards[shardOf(string(name), len(s.shards))]
+}
+
+func (s *shardedCache) Set(key Key, value interface{}) (bool, error) {
+	name := fileKey(key)
+	return s.shard(name).set(name, value)
+}
+
+func (s *shardedCache) Get(key Key) (interface{}, bool, error) {
+	name := fileKey(key)
+	return s.shard(name).get(name)
+}
+
+func (s *shardedCache) touch(key Key) {
+	name := fileKey(key)
+	s.shard(name).access(name)
+}
+
+func (s *shardedCache) Clear() error {
+	for _, l := range s.shards {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+	}
+	path := s.shards[0].path
+	if err := drop(path); err != nil {
+		return fmt.Errorf("can't remove files from %s:\n %w", path, err)
+	}
+	for _, l := range s.shards {
+		l.reset()
+	}
+	return nil
+}
+
+// Close сохраняет общий индекс всех шардов, если это включено в Options.
+func (s *shardedCache) Close() error {
+	if !s.index {
+		return nil
+	}
+	var (
+		b   []byte
+		err error
+	)
+	for _, l := range s.shards {
+		l.mx.Lock()
+		b, err = l.appendIndex(b)
+		l.mx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return writeIndex(s.shards[0].path, b)
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := New(Options{Capacity: 40, Path: cacheDir, Index: true, Shards: 4})
+	require.NoError(t, err)
+	s := c.(*shardedCache)
+	require.Len(t, s.shards, 4)
+	for _, l := range s.shards {
+		require.Equal(t, 10, l.capacity)
+	}
+
+	for i := 0; i < 100; i++ {
+		k := Key(strconv.Itoa(i))
+		_, err = c.Set(k, Entry{Value: []byte(k), Meta: Meta{ETag: string(k)}})
+		require.NoError(t, err)
+	}
+	stored := map[Key]bool{}
+	for i := 0; i < 100; i++ {
+		k := Key(strconv.Itoa(i))
+		v, ok, err := c.Get(k)
+		require.NoError(t, err)
+		if ok {
+			stored[k] = true
+			require.Equal(t, Entry{Value: []byte(k), Meta: Meta{ETag: string(k)}}, v)
+		}
+	}
+	// Каждый шард заполнен до своей доли, файлы лежат в общем каталоге.
+	require.Len(t, stored, 40)
+	for _, l := range s.shards {
+		require.Equal(t, 10, len(l.items))
+		for name := range l.items {
+			require.Equal(t, l, s.shard(name))
+		}
+	}
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 80)
+
+	// Индекс общий: после перезапуска с другим числом шардов значения
+	// перераспределяются между ними.
+	require.NoError(t, c.Close())
+	c, err = New(Options{Path: cacheDir, Index: true, Shards: 8})
+	require.NoError(t, err)
+	for k := range stored {
+		_, ok, err := c.Get(k)
+		require.NoError(t, err)
+		require.True(t, ok, k)
+	}
+
+	require.NoError(t, c.Clear())
+	files, err = ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+	for k := range stored {
+		_, ok, err := c.Get(k)
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+}
+
+func TestShardedCacheSmall(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+
+	// На 20 значений хватает двух шардов: в каждом не меньше minShardItems.
+	c, err := New(Options{Capacity: 20, Path: cacheDir, Shards: 16})
+	require.NoError(t, err)
+	require.Len(t, c.(*shardedCache).shards, 2)
+	require.NoError(t, c.Close())
+
+	for _, shards := range []int{16, 1, 0} {
+		c, err = New(Options{Capacity: 5, Path: cacheDir, Shards: shards})
+		require.NoError(t, err)
+		l, ok := c.(*diskCache)
+		require.True(t, ok, shards)
+		require.Equal(t, 5, l.capacity)
+		require.NoError(t, c.Close())
+	}
+
+	// Бюджет MaxBytes делится между шардами: значение больше доли шарда не
+	// сохраняется, даже если весь кэш пуст.
+	c, err = New(Options{Capacity: 16, MaxBytes: 100, Path: cacheDir, Shards: 2})
+	require.NoError(t, err)
+	_, err = c.Set("aaa", make([]byte, 50))
+	require.NoError(t, err)
+	_, err = c.Set("bbb", make([]byte, 51))
+	require.True(t, errors.Is(err, ErrTooLarge), err)
+	require.NoError(t, c.Close())
+}
+
+func TestShardedCacheMultithreading(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := New(Options{Capacity: 64, Path: cacheDir, Shards: 8})
+	require.NoError(t, err)
+
+	// Значение по ключу всегда одно и то же: любое прочитанное должно совпасть.
+	value := func(k Key) interface{} {
+		if len(k)%2 == 0 {
+			return []byte(k)
+		}
+		return Entry{Value: []byte(k), Meta: Meta{ETag: string(k)}}
+	}
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				k := Key(strconv.Itoa(rand.Intn(200)))
+				if rand.Intn(2) == 0 {
+					_, err := c.Set(k, value(k))
+					require.NoError(t, err)
+					continue
+				}
+				v, ok, err := c.Get(k)
+				require.NoError(t, err)
+				if ok {
+					require.Equal(t, value(k), v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	var n int
+	for _, l := range c.(*shardedCache).shards {
+		n += len(l.items)
+	}
+	require.LessOrEqual(t, n, 64)
+	require.LessOrEqual(t, len(files), 2*n)
+}
+
+// benchmarkParallel - смешанная нагрузка из параллельных Get и Set по 1000 ключей.
+func benchmarkParallel(b *testing.B, shards int) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(b, err, err)
+	defer os.RemoveAll(cacheDir)
+	c, err := New(Options{Capacity: 500, Path: cacheDir, Shards: shards})
+	require.NoError(b, err)
+	pic := make([]byte, 16<<10)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			k := Key(strconv.Itoa(r.Intn(1000)))
+			if r.Intn(4) == 0 {
+				if _, err := c.Set(k, pic); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			if _, _, err := c.Get(k); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) { benchmarkParallel(b, shards) })
+	}
+}
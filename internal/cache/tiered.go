@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats - счетчики попаданий по уровням кэша.
+type Stats struct {
+	MemoryHits  int64
+	DiskHits    int64
+	Misses      int64
+	MemoryItems int
+	MemoryBytes int64
+}
+
+// tieredCache - горячие значения в памяти поверх дискового кэша. Запись
+// сквозная: значение сохраняется на диск и в память. Значение, найденное только
+// на диске, поднимается в память; вытесненное из памяти просто отбрасывается -
+// на диске оно уже есть. Чтобы диск не вытеснил значение, которое читается
+// только из памяти, попадание в память учитывается и политикой диска.
+type tieredCache struct {
+	disk Cache
+
+	mx     sync.Mutex // защищает mem и writes
+	mem    *memCache
+	writes uint64 // число записей на диск; подъем с диска, пересекшийся с записью, пропускается
+
+	// wmx упорядочивают записи одного значения из параллельных Set, чтобы в
+	// памяти и на диске осталось одно и то же; блокировка выбирается по хэшу ключа.
+	wmx [64]sync.Mutex
+
+	memHits  int64
+	diskHits int64
+	misses   int64
+}
+
+// toucher - кэш, которому можно сообщить об обращении к значению без его
+// чтения.
+type toucher interface {
+	touch(key Key)
+}
+
+func newTieredCache(disk Cache, memoryBytes int64) *tieredCache {
+	return &tieredCache{disk: disk, mem: newMemCache(memoryBytes)}
+}
+
+func (t *tieredCache) Set(key Key, value interface{}) (bool, error) {
+	if _, _, err := encode(value); err != nil {
+		return false, err
+	}
+	wmx := t.writeLock(key)
+	wmx.Lock()
+	t.mx.Lock()
+	t.writes++
+	t.mem.add(key, value, valueSize(value))
+	t.mx.Unlock()
+	exists, err := t.disk.Set(key, value)
+	wmx.Unlock()
+	return exists, err
+}
+
+func (t *tieredCache) Get(key Key) (interface{}, bool, error) {
+	t.mx.Lock()
+	if v, ok := t.mem.get(key); ok {
+		t.mx.Unlock()
+		if d, ok := t.disk.(toucher); ok {
+			d.touch(key)
+		}
+		atomic.AddInt64(&t.memHits, 1)
+		return v, true, nil
+	}
+	seen := t.writes
+	t.mx.Unlock()
+
+	v, ok, err := t.disk.Get(key)
+	if err != nil || !ok {
+		atomic.AddInt64(&t.misses, 1)
+		return v, ok, err
+	}
+	atomic.AddInt64(&t.diskHits, 1)
+	t.mx.Lock()
+	if t.writes == seen && !t.mem.has(key) {
+		t.mem.add(key, v, valueSize(v))
+	}
+	t.mx.Unlock()
+	return v, true, nil
+}
+
+func (t *tieredCache) writeLock(key Key) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &t.wmx[h.Sum32()%uint32(len(t.wmx))]
+}
+
+func (t *tieredCache) Clear() error {
+	for i := range t.wmx {
+		t.wmx[i].Lock()
+		defer t.wmx[i].Unlock()
+	}
+	t.mx.Lock()
+	t.writes++
+	t.mem.clear()
+	t.mx.Unlock()
+	return t.disk.Clear()
+}
+
+func (t *tieredCache) Close() error {
+	return t.disk.Close()
+}
+
+// Stats возвращает счетчики попаданий по уровням.
+func (t *tieredCache) Stats() Stats {
+	t.mx.Lock()
+	items, bytes := t.mem.queue.Len(), t.mem.size
+	t.mx.Unlock()
+	return Stats{
+		MemoryHits:  atomic.LoadInt64(&t.memHits),
+		DiskHits:    atomic.LoadInt64(&t.diskHits),
+		Misses:      atomic.LoadInt64(&t.misses),
+		MemoryItems: items,
+		MemoryBytes: bytes,
+	}
+}
+
+// valueSize - сколько памяти занимает значение.
+func valueSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case []byte:
+		return int64(len(v))
+	case Entry:
+		return int64(len(v.Value) + len(v.ETag) + len(v.LastModified))
+	}
+	return 0
+}
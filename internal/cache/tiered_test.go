@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTiered(t *testing.T, capacity int, memoryBytes int64) (*tieredCache, *diskCache) {
+	cacheDir, err := ioutil.TempDir("", "cache_.")
+	require.NoError(t, err, err)
+	t.Cleanup(func() { os.RemoveAll(cacheDir) })
+	c, err := New(Options{Capacity: capacity, Path: cacheDir, MemoryBytes: memoryBytes})
+	require.NoError(t, err)
+	tc := c.(*tieredCache)
+	return tc, tc.disk.(*diskCache)
+}
+
+func TestTieredCache(t *testing.T) {
+	c, disk := newTiered(t, 10, 20)
+	get := func(key Key) interface{} {
+		v, ok, err := c.Get(key)
+		require.NoError(t, err)
+		require.True(t, ok, key)
+		return v
+	}
+
+	// Запись сквозная.
+	_, err := c.Set("aaa", []byte("0123456789"))
+	require.NoError(t, err)
+	require.True(t, c.mem.has("aaa"))
+	_, ok := disk.items[fileKey("aaa")]
+	require.True(t, ok)
+	require.Equal(t, []byte("0123456789"), get("aaa"))
+	require.Equal(t, Stats{MemoryHits: 1, MemoryItems: 1, MemoryBytes: 10}, c.Stats())
+
+	// Вытесненное из памяти остается на диске и поднимается обратно при чтении.
+	_, err = c.Set("bbb", []byte("0123456789"))
+	require.NoError(t, err)
+	_, err = c.Set("ccc", []byte("0123456789"))
+	require.NoError(t, err)
+	require.False(t, c.mem.has("aaa"))
+	require.Equal(t, []byte("0123456789"), get("aaa"))
+	require.True(t, c.mem.has("aaa"))
+	require.False(t, c.mem.has("bbb"))
+
+	_, ok, err = c.Get("zzz")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, Stats{MemoryHits: 1, DiskHits: 1, Misses: 1, MemoryItems: 2, MemoryBytes: 20}, c.Stats())
+
+	// Значение больше памяти хранится только на диске.
+	_, err = c.Set("big", []byte("012345678901234567890"))
+	require.NoError(t, err)
+	require.False(t, c.mem.has("big"))
+	require.Equal(t, []byte("012345678901234567890"), get("big"))
+
+	// Замена значения видна сразу в обоих уровнях.
+	_, err = c.Set("aaa", Entry{Value: []byte("new"), Meta: Meta{ETag: "v2"}})
+	require.NoError(t, err)
+	require.Equal(t, Entry{Value: []byte("new"), Meta: Meta{ETag: "v2"}}, get("aaa"))
+	v, ok, err := disk.Get("aaa")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, Entry{Value: []byte("new"), Meta: Meta{ETag: "v2"}}, v)
+
+	require.NoError(t, c.Clear())
+	_, ok, err = c.Get("aaa")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, 0, c.Stats().MemoryItems)
+}
+
+func TestTieredCacheEviction(t *testing.T) {
+	// Чтения из памяти учитываются политикой диска: горячее значение не
+	// вытесняется с диска, пока его читают.
+	c, disk := newTiered(t, 2, 10)
+	_, err := c.Set("hot", []byte("0123456789"))
+	require.NoError(t, err)
+	for _, k := range []Key{"aaa", "bbb", "ccc"} {
+		_, _, err = c.Get("hot")
+		require.NoError(t, err)
+		_, err = disk.Set(k, []byte("x"))
+		require.NoError(t, err)
+		_, ok := disk.items[fileKey("hot")]
+		require.True(t, ok, k)
+	}
+	require.Equal(t, int64(3), c.Stats().MemoryHits)
+
+	// Вытесненное из памяти не записывается на диск повторно, а читается с
+	// него и поднимается обратно.
+	_, _, err = c.Get("hot")
+	require.NoError(t, err)
+	_, err = c.Set("ddd", []byte("0123456789"))
+	require.NoError(t, err)
+	require.False(t, c.mem.has("hot"))
+	v, ok, err := c.Get("hot")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("0123456789"), v)
+	require.True(t, c.mem.has("hot"))
+	require.Equal(t, int64(1), c.Stats().DiskHits)
+}
+
+func TestTieredCacheMultithreading(t *testing.T) {
+	c, _ := newTiered(t, 50, 100)
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := Key(strconv.Itoa(rand.Intn(100)))
+				_, err := c.Set(k, []byte(k))
+				require.NoError(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := Key(strconv.Itoa(rand.Intn(100)))
+				v, ok, err := c.Get(k)
+				require.NoError(t, err)
+				if ok {
+					require.Equal(t, []byte(k), v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	st := c.Stats()
+	require.Equal(t, int64(4000), st.MemoryHits+st.DiskHits+st.Misses)
+	require.LessOrEqual(t, st.MemoryBytes, int64(100))
+}
@@ -9,15 +9,78 @@ import (
 
 type Config struct {
 	Server struct {
-		Address string
-		Port    string
+		Address      string
+		Port         string
+		AdminAddress string
 	}
 	Cache struct {
-		Capacity    int
-		StoragePath string
+		Capacity             int
+		MaxBytes             int64
+		StoragePath          string
+		Index                bool
+		Shards               int
+		Policy               string
+		Admission            string
+		MemoryBytes          int64
+		Backend              string
+		RedisAddr            string
+		RedisPassword        string
+		RedisDB              int
+		Prefix               string
+		MaxValueBytes        int64
+		S3Endpoint           string
+		S3Region             string
+		S3Bucket             string
+		S3AccessKey          string
+		S3SecretKey          string
+		DefaultTTL           int
+		MinTTL               int
+		MaxTTL               int
+		StaleWhileRevalidate int
+		StaleIfError         int
 	}
 	Query struct {
-		Timeout int
+		Timeout               int
+		MaxBodySize           int64
+		MaxIdleConns          int
+		MaxIdleConnsPerHost   int
+		IdleConnTimeout       int
+		DialTimeout           int
+		TLSHandshakeTimeout   int
+		ResponseHeaderTimeout int
+		HTTP2                 bool
+	}
+	Origin struct {
+		Allow        []string
+		Deny         []string
+		AllowPrivate bool
+	}
+	Headers struct {
+		Forward      []string
+		Strip        []string
+		Set          map[string]string
+		UserAgent    string
+		ForwardedFor bool
+		Origins      []struct {
+			Host      string
+			Forward   []string
+			Strip     []string
+			Set       map[string]string
+			UserAgent string
+		}
+	}
+	Converter struct {
+		Background     string
+		DefaultQuality int
+		MinQuality     int
+		MaxQuality     int
+		MaxFrames      int
+		KeepMetadata   bool
+		MaxPixels      int
+		MaxSize        int
+		Workers        int
+		QueueSize      int
+		QueueTimeout   int
 	}
 	Log struct {
 		File       string
@@ -37,20 +100,87 @@ func NewConfig(configFile string) (Config, error) {
 	if err != nil {
 		return config, err
 	}
-	_, err = toml.Decode(string(s), &config)
-	return config, err
+	config.SetDefault()
+	if _, err = toml.Decode(string(s), &config); err != nil {
+		return Config{}, err
+	}
+	return config, nil
 }
 
 func (c *Config) SetDefault() {
 	c.Server = struct {
-		Address string
-		Port    string
+		Address      string
+		Port         string
+		AdminAddress string
 	}{Address: "0.0.0.0", Port: "8080"}
 	c.Cache = struct {
-		Capacity    int
-		StoragePath string
-	}{Capacity: 20, StoragePath: "./assets/cache"}
-	c.Query = struct{ Timeout int }{Timeout: 15}
+		Capacity             int
+		MaxBytes             int64
+		StoragePath          string
+		Index                bool
+		Shards               int
+		Policy               string
+		Admission            string
+		MemoryBytes          int64
+		Backend              string
+		RedisAddr            string
+		RedisPassword        string
+		RedisDB              int
+		Prefix               string
+		MaxValueBytes        int64
+		S3Endpoint           string
+		S3Region             string
+		S3Bucket             string
+		S3AccessKey          string
+		S3SecretKey          string
+		DefaultTTL           int
+		MinTTL               int
+		MaxTTL               int
+		StaleWhileRevalidate int
+		StaleIfError         int
+	}{
+		Capacity: 20, MaxBytes: 1 << 30, StoragePath: "./assets/cache", Index: true, Shards: 1, Policy: "lru", MemoryBytes: 64 << 20,
+		Backend: "disk", RedisAddr: "localhost:6379", Prefix: "previewer:", MaxValueBytes: 32 << 20,
+		S3Endpoint: "https://s3.amazonaws.com", S3Region: "us-east-1", S3Bucket: "previewer",
+		DefaultTTL: 3600, MinTTL: 60, MaxTTL: 604800, StaleWhileRevalidate: 0, StaleIfError: 86400,
+	}
+	c.Query = struct {
+		Timeout               int
+		MaxBodySize           int64
+		MaxIdleConns          int
+		MaxIdleConnsPerHost   int
+		IdleConnTimeout       int
+		DialTimeout           int
+		TLSHandshakeTimeout   int
+		ResponseHeaderTimeout int
+		HTTP2                 bool
+	}{
+		Timeout: 15, MaxBodySize: 32 << 20, MaxIdleConns: 100, MaxIdleConnsPerHost: 10, IdleConnTimeout: 90,
+		DialTimeout: 10, TLSHandshakeTimeout: 10, ResponseHeaderTimeout: 10, HTTP2: true,
+	}
+	c.Origin = struct {
+		Allow        []string
+		Deny         []string
+		AllowPrivate bool
+	}{}
+	c.Headers.UserAgent = "previewer"
+	c.Headers.ForwardedFor = true
+	c.Converter = struct {
+		Background     string
+		DefaultQuality int
+		MinQuality     int
+		MaxQuality     int
+		MaxFrames      int
+		KeepMetadata   bool
+		MaxPixels      int
+		MaxSize        int
+		Workers        int
+		QueueSize      int
+		QueueTimeout   int
+	}{
+		Background: "ffffff", DefaultQuality: 80, MinQuality: 1, MaxQuality: 100, MaxFrames: 100, MaxPixels: 50000000, MaxSize: 8192,
+		Workers: 0, QueueSize: 64, QueueTimeout: 5,
+	}
 	c.Log = struct {
 		File       string
 		Level      string
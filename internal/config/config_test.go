@@ -50,4 +50,71 @@ Port = "80"`)
 		require.NoError(t, e)
 	})
 
+	t.Run("Per-origin headers", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "conf.")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		f.WriteString(`[Headers]
+Forward = ["Accept-Language"]
+
+[[Headers.Origins]]
+Host = "*.cdn.net"
+Set = { Authorization = "Bearer x" }`)
+		f.Sync()
+		c, e := NewConfig(f.Name())
+		require.NoError(t, e)
+		require.Equal(t, []string{"Accept-Language"}, c.Headers.Forward)
+		require.Equal(t, "previewer", c.Headers.UserAgent)
+		require.Len(t, c.Headers.Origins, 1)
+		require.Equal(t, "*.cdn.net", c.Headers.Origins[0].Host)
+		require.Equal(t, "Bearer x", c.Headers.Origins[0].Set["Authorization"])
+	})
+
+	t.Run("Defaults for missed keys", func(t *testing.T) {
+		c, e := NewConfig(goodfile.Name())
+		require.NoError(t, e)
+		require.Equal(t, "", c.Server.AdminAddress)
+		require.Equal(t, 20, c.Cache.Capacity)
+		require.Equal(t, int64(1<<30), c.Cache.MaxBytes)
+		require.True(t, c.Cache.Index)
+		require.Equal(t, 1, c.Cache.Shards)
+		require.Equal(t, "lru", c.Cache.Policy)
+		require.Equal(t, "", c.Cache.Admission)
+		require.Equal(t, int64(64<<20), c.Cache.MemoryBytes)
+		require.Equal(t, "disk", c.Cache.Backend)
+		require.Equal(t, "localhost:6379", c.Cache.RedisAddr)
+		require.Equal(t, "", c.Cache.RedisPassword)
+		require.Equal(t, 0, c.Cache.RedisDB)
+		require.Equal(t, "previewer:", c.Cache.Prefix)
+		require.Equal(t, int64(32<<20), c.Cache.MaxValueBytes)
+		require.Equal(t, "https://s3.amazonaws.com", c.Cache.S3Endpoint)
+		require.Equal(t, "us-east-1", c.Cache.S3Region)
+		require.Equal(t, "previewer", c.Cache.S3Bucket)
+		require.Equal(t, "", c.Cache.S3AccessKey)
+		require.Equal(t, "", c.Cache.S3SecretKey)
+		require.Equal(t, 3600, c.Cache.DefaultTTL)
+		require.Equal(t, 60, c.Cache.MinTTL)
+		require.Equal(t, 604800, c.Cache.MaxTTL)
+		require.Equal(t, 0, c.Cache.StaleWhileRevalidate)
+		require.Equal(t, 86400, c.Cache.StaleIfError)
+		require.Equal(t, "ffffff", c.Converter.Background)
+		require.Equal(t, 80, c.Converter.DefaultQuality)
+		require.Equal(t, 1, c.Converter.MinQuality)
+		require.Equal(t, 100, c.Converter.MaxQuality)
+		require.Equal(t, 100, c.Converter.MaxFrames)
+		require.False(t, c.Converter.KeepMetadata)
+		require.Equal(t, 50000000, c.Converter.MaxPixels)
+		require.Equal(t, 8192, c.Converter.MaxSize)
+		require.Equal(t, 64, c.Converter.QueueSize)
+		require.Equal(t, 5, c.Converter.QueueTimeout)
+		require.Equal(t, int64(32<<20), c.Query.MaxBodySize)
+		require.Equal(t, 10, c.Query.MaxIdleConnsPerHost)
+		require.True(t, c.Query.HTTP2)
+		require.Empty(t, c.Origin.Allow)
+		require.False(t, c.Origin.AllowPrivate)
+		require.Equal(t, "previewer", c.Headers.UserAgent)
+		require.True(t, c.Headers.ForwardedFor)
+		require.Empty(t, c.Headers.Forward)
+	})
+
 }
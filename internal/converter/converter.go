@@ -1,86 +1,141 @@
 package converter
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
-	"net/http"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/anthonynsimon/bild/transform"
+	"github.com/tiburon-777/OTUS_Project/internal/webp"
 )
 
+type Mode string
+
+const (
+	ModeFill    Mode = "fill"    // масштабирование с заполнением и обрезкой с учетом Gravity
+	ModeFit     Mode = "fit"     // уменьшение с сохранением пропорций, без обрезки
+	ModeFitIn   Mode = "fit-in"  // как fit, но с полями цвета Background до размера WxH
+	ModeStretch Mode = "stretch" // масштабирование без сохранения пропорций
+	ModeCrop    Mode = "crop"    // вырезание области X,Y,W,H без масштабирования
+)
+
+type Options struct {
+	Mode       Mode
+	Width      int
+	Height     int
+	X          int
+	Y          int
+	Gravity    Gravity
+	Background color.NRGBA
+	Format     Format
+	Quality    int    // качество lossy-кодирования (JPEG, WebP из JPEG), 0 - по умолчанию
+	Prefer     Format // формат, если Format не задан; анимацию он не отменяет
+	MaxFrames  int    // предел числа кадров GIF, 0 - без ограничения
+	KeepMeta   bool   // сохранять EXIF исходного JPEG в результате
+	MaxPixels  int    // предел ширина*высота исходной картинки, 0 - без ограничения
+}
+
 type Image struct {
 	image.Image
 }
 
-func SelectType(width int, height int, b []byte) ([]byte, error) {
-	contentType := http.DetectContentType(b)
-	var decode func(b []byte) (image.Image, error)
-	var encode func(m image.Image) ([]byte, error)
-	switch contentType {
-	case "image/jpeg":
-		decode = func(b []byte) (image.Image, error) {
-			tb := bytes.NewBuffer(b)
-			return jpeg.Decode(tb)
-		}
-		encode = func(m image.Image) ([]byte, error) {
-			res := bytes.NewBuffer([]byte{})
-			err := jpeg.Encode(res, m, &jpeg.Options{Quality: 80})
-			return res.Bytes(), err
-		}
-	case "image/png":
-		decode = func(b []byte) (image.Image, error) {
-			tb := bytes.NewBuffer(b)
-			return png.Decode(tb)
-		}
-		encode = func(m image.Image) ([]byte, error) {
-			res := bytes.NewBuffer([]byte{})
-			err := png.Encode(res, m)
-			return res.Bytes(), err
-		}
-	case "image/gif":
-		decode = func(b []byte) (image.Image, error) {
-			tb := bytes.NewBuffer(b)
-			return gif.Decode(tb)
-		}
-		encode = func(m image.Image) ([]byte, error) {
-			res := bytes.NewBuffer([]byte{})
-			err := gif.Encode(res, m, nil)
-			return res.Bytes(), err
-		}
-	default:
-		decode = func(b []byte) (image.Image, error) {
-			return nil, errors.New("unknown format")
+// SelectType декодирует картинку, обрабатывает её согласно Options и кодирует
+// в формат o.Format или, если он не задан, в o.Prefer либо формат исходной
+// картинки. Анимированный GIF остается анимацией, если явно не запрошен
+// другой формат, иначе берется первый кадр. JPEG поворачивается согласно EXIF
+// Orientation до любых преобразований.
+func SelectType(o Options, b []byte) ([]byte, error) {
+	src := DetectFormat(b)
+	if src == "" {
+		return nil, ErrUnknownFormat
+	}
+	if err := checkPixels(b, o.MaxPixels); err != nil {
+		return nil, err
+	}
+	var (
+		i    image.Image
+		exif []byte
+		err  error
+	)
+	// Для явно запрошенного статичного формата из GIF нужен только первый кадр:
+	// остальные не декодируются и в ограничение числа кадров не входят.
+	if src == FormatGIF && (o.Format == "" || o.Format == FormatGIF) {
+		g, err := decodeGIF(b, o.MaxFrames, o.MaxPixels)
+		if err != nil {
+			return nil, err
 		}
-		encode = func(m image.Image) ([]byte, error) {
-			return nil, errors.New("unknown format")
+		if len(g.Image) > 1 {
+			return processAnimation(g, o)
 		}
-	}
-	i, err := decode(b)
-	if err != nil {
+		i = g.Image[0]
+	} else if i, err = decode(src, b); err != nil {
 		return nil, err
 	}
+	if src == FormatJPEG {
+		exif = readEXIF(b)
+		i = orient(i, orientation(exif))
+	}
 	m := NewImage(i)
-	if err = m.convert(width, height); err != nil {
+	if err = m.process(o); err != nil {
 		return nil, err
 	}
-	return encode(m.Image)
+	if !o.KeepMeta {
+		exif = nil
+	}
+	exif = resetOrientation(exif)
+	if o.Format != "" {
+		return encode(m.Image, o.Format, src, o.Quality, exif)
+	}
+	if o.Prefer != "" {
+		// Предпочтительный формат - лишь пожелание клиента: если картинку в нем не
+		// закодировать (WebP ограничен 16383 px), отдается формат исходной.
+		res, err := encode(m.Image, o.Prefer, src, o.Quality, exif)
+		if !errors.Is(err, webp.ErrTooLarge) {
+			return res, err
+		}
+	}
+	return encode(m.Image, src, src, o.Quality, exif)
 }
 
 func NewImage(img image.Image) Image {
 	return Image{Image{img}}
 }
 
-func (img *Image) convert(width int, height int) error {
+func (img *Image) process(o Options) error {
+	switch o.Mode {
+	case ModeFill:
+		return img.convert(o.Width, o.Height, o.Gravity)
+	case ModeFit:
+		return img.fit(o.Width, o.Height)
+	case ModeFitIn:
+		return img.fitIn(o.Width, o.Height, o.Background)
+	case ModeStretch:
+		return img.resize(o.Width, o.Height)
+	case ModeCrop:
+		if o.Width <= 0 || o.Height <= 0 {
+			return errors.New("can't crop to zero or negative size")
+		}
+		return img.crop(image.Point{X: o.X, Y: o.Y}, image.Point{X: o.X + o.Width, Y: o.Y + o.Height})
+	default:
+		return fmt.Errorf("unknown mode %q", o.Mode)
+	}
+}
+
+func (img *Image) convert(width int, height int, g Gravity) error {
 	widthOrig := img.Bounds().Max.X
 	heightOrig := img.Bounds().Max.Y
 	if width <= 0 || height <= 0 {
 		return errors.New("can't reduce toOrBelow zero")
 	}
+	fx, fy, err := g.focalPoint()
+	if err != nil {
+		return err
+	}
 	sfOriginal := sizeFactor(widthOrig, heightOrig)
 	sfNew := sizeFactor(width, height)
 
@@ -90,7 +145,11 @@ func (img *Image) convert(width int, height int) error {
 		if err := img.resize(calcWidth, height); err != nil {
 			return err
 		}
-		if err := img.crop(image.Point{X: (calcWidth - width) / 2, Y: 0}, image.Point{X: (calcWidth-width)/2 + width, Y: height}); err != nil {
+		x := cropOffset(calcWidth, width, fx)
+		if g == GravitySmart {
+			x = smartCrop(img.Image, width, height).X
+		}
+		if err := img.crop(image.Point{X: x, Y: 0}, image.Point{X: x + width, Y: height}); err != nil {
 			return err
 		}
 	case sfOriginal == sfNew:
@@ -102,13 +161,43 @@ func (img *Image) convert(width int, height int) error {
 		if err := img.resize(width, calcHeight); err != nil {
 			return err
 		}
-		if err := img.crop(image.Point{X: 0, Y: (calcHeight - height) / 2}, image.Point{X: width, Y: (calcHeight-height)/2 + height}); err != nil {
+		y := cropOffset(calcHeight, height, fy)
+		if g == GravitySmart {
+			y = smartCrop(img.Image, width, height).Y
+		}
+		if err := img.crop(image.Point{X: 0, Y: y}, image.Point{X: width, Y: y + height}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (img *Image) fit(width int, height int) error {
+	if width <= 0 || height <= 0 {
+		return errors.New("can't reduce toOrBelow zero")
+	}
+	widthOrig := img.Bounds().Dx()
+	heightOrig := img.Bounds().Dy()
+	if widthOrig <= width && heightOrig <= height {
+		return nil
+	}
+	scale := math.Min(float64(width)/float64(widthOrig), float64(height)/float64(heightOrig))
+	return img.resize(max(int(math.Round(float64(widthOrig)*scale)), 1), max(int(math.Round(float64(heightOrig)*scale)), 1))
+}
+
+func (img *Image) fitIn(width int, height int, bg color.Color) error {
+	if err := img.fit(width, height); err != nil {
+		return err
+	}
+	b := image.Rect(0, 0, width, height)
+	resImg := image.NewRGBA(b)
+	draw.Draw(resImg, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	offset := image.Point{X: (width - img.Bounds().Dx()) / 2, Y: (height - img.Bounds().Dy()) / 2}
+	draw.Draw(resImg, img.Bounds().Sub(img.Bounds().Min).Add(offset), img.Image, img.Bounds().Min, draw.Over)
+	img.Image = resImg
+	return nil
+}
+
 func (img *Image) resize(width, height int) error {
 	if width <= 0 || height <= 0 {
 		return errors.New("can't resize to zero or negative value")
@@ -122,10 +211,11 @@ func (img *Image) crop(p1 image.Point, p2 image.Point) error {
 	if img.Image == nil {
 		return errors.New("corrupted image")
 	}
-	if p1.X < 0 || p1.Y < 0 || p2.X > img.Image.Bounds().Max.X || p2.Y > img.Image.Bounds().Max.Y {
+	b := img.Image.Bounds()
+	if p1.X < 0 || p1.Y < 0 || p2.X < p1.X || p2.Y < p1.Y || p2.X > b.Max.X || p2.Y > b.Max.Y {
 		return errors.New("not valid corner points")
 	}
-	b := image.Rect(0, 0, p2.X-p1.X, p2.Y-p1.Y)
+	b = image.Rect(0, 0, p2.X-p1.X, p2.Y-p1.Y)
 	resImg := image.NewRGBA(b)
 	draw.Draw(resImg, b, img.Image, p1, draw.Src)
 	img.Image = resImg
@@ -135,3 +225,29 @@ func (img *Image) crop(p1 image.Point, p2 image.Point) error {
 func sizeFactor(width int, height int) float64 {
 	return float64(width) / float64(height)
 }
+
+// ParseColor разбирает цвет в hex-нотации: RGB, RRGGBB или RRGGBBAA.
+func ParseColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	if len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("not valid color %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("not valid color %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
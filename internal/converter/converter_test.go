@@ -3,6 +3,8 @@ package converter
 import (
 	"github.com/stretchr/testify/require"
 	"image"
+	"image/color"
+	"image/draw"
 	"testing"
 )
 
@@ -80,6 +82,9 @@ func TestCropSlow(t *testing.T) {
 		{
 			topLeft: image.Point{X: 0, Y: 100}, bottomRight: image.Point{X: 1000, Y: 2000}, expectedX: 1000, expectedY: 1000, err: true, msg: "Too tall crop with positive offset",
 		},
+		{
+			topLeft: image.Point{X: 100, Y: 0}, bottomRight: image.Point{X: -100, Y: 1000}, expectedX: 1000, expectedY: 1000, err: true, msg: "Overflowed corner",
+		},
 	}
 
 	for _, dat := range table {
@@ -138,7 +143,7 @@ func TestConvertSlow(t *testing.T) {
 		t.Run(dat.msg, func(t *testing.T) {
 			img := Image{Image: createImage(800, 600)}
 			i := false
-			err := img.convert(dat.width, dat.height)
+			err := img.convert(dat.width, dat.height, GravityCenter)
 			if err != nil {
 				i = true
 			}
@@ -149,6 +154,129 @@ func TestConvertSlow(t *testing.T) {
 	}
 }
 
+func TestFitSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	table := []struct {
+		width     int
+		height    int
+		expectedX int
+		expectedY int
+		err       bool
+		msg       string
+	}{
+		{
+			width: 400, height: 400, expectedX: 400, expectedY: 300, err: false, msg: "Limited by width",
+		},
+		{
+			width: 800, height: 300, expectedX: 400, expectedY: 300, err: false, msg: "Limited by height",
+		},
+		{
+			width: 1600, height: 1200, expectedX: 800, expectedY: 600, err: false, msg: "No upscale",
+		},
+		{
+			width: 0, height: 0, expectedX: 800, expectedY: 600, err: true, msg: "Fit to zero",
+		},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			img := Image{Image: createImage(800, 600)}
+			err := img.fit(dat.width, dat.height)
+			require.Equal(t, dat.err, err != nil, dat.msg)
+			require.Equal(t, dat.expectedX, img.Image.Bounds().Max.X, dat.msg)
+			require.Equal(t, dat.expectedY, img.Image.Bounds().Max.Y, dat.msg)
+		})
+	}
+}
+
+func TestFitInSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	red := color.NRGBA{R: 255, A: 255}
+	blue := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	draw.Draw(blue, blue.Bounds(), image.NewUniform(color.NRGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	img := Image{Image: blue}
+	require.NoError(t, img.fitIn(400, 400, red))
+	require.Equal(t, image.Rect(0, 0, 400, 400), img.Bounds())
+	// Картинка 400x300 по центру, сверху и снизу поля по 50px
+	require.Equal(t, color.RGBAModel.Convert(red), color.RGBAModel.Convert(img.At(200, 10)))
+	require.Equal(t, color.RGBAModel.Convert(red), color.RGBAModel.Convert(img.At(200, 390)))
+	require.Equal(t, color.RGBAModel.Convert(color.NRGBA{B: 255, A: 255}), color.RGBAModel.Convert(img.At(200, 200)))
+
+	img = Image{Image: createImage(800, 600)}
+	require.Error(t, img.fitIn(0, 400, red))
+}
+
+func TestProcessSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	table := []struct {
+		opts      Options
+		expectedX int
+		expectedY int
+		err       bool
+		msg       string
+	}{
+		{
+			opts: Options{Mode: ModeFill, Width: 300, Height: 300}, expectedX: 300, expectedY: 300, err: false, msg: "Fill",
+		},
+		{
+			opts: Options{Mode: ModeFit, Width: 300, Height: 300}, expectedX: 300, expectedY: 225, err: false, msg: "Fit",
+		},
+		{
+			opts: Options{Mode: ModeFitIn, Width: 300, Height: 300}, expectedX: 300, expectedY: 300, err: false, msg: "Fit-in",
+		},
+		{
+			opts: Options{Mode: ModeStretch, Width: 100, Height: 900}, expectedX: 100, expectedY: 900, err: false, msg: "Stretch",
+		},
+		{
+			opts: Options{Mode: ModeCrop, X: 100, Y: 50, Width: 200, Height: 100}, expectedX: 200, expectedY: 100, err: false, msg: "Crop",
+		},
+		{
+			opts: Options{Mode: ModeCrop, X: 700, Y: 0, Width: 200, Height: 100}, expectedX: 800, expectedY: 600, err: true, msg: "Crop out of bounds",
+		},
+		{
+			opts: Options{Mode: ModeCrop, X: 0, Y: 0, Width: 0, Height: 100}, expectedX: 800, expectedY: 600, err: true, msg: "Crop to zero",
+		},
+		{
+			opts: Options{Mode: "unknown", Width: 300, Height: 300}, expectedX: 800, expectedY: 600, err: true, msg: "Unknown mode",
+		},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			img := Image{Image: createImage(800, 600)}
+			err := img.process(dat.opts)
+			require.Equal(t, dat.err, err != nil, dat.msg)
+			require.Equal(t, dat.expectedX, img.Image.Bounds().Max.X, dat.msg)
+			require.Equal(t, dat.expectedY, img.Image.Bounds().Max.Y, dat.msg)
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	c, err := ParseColor("fff")
+	require.NoError(t, err)
+	require.Equal(t, color.NRGBA{R: 255, G: 255, B: 255, A: 255}, c)
+
+	c, err = ParseColor("#102030")
+	require.NoError(t, err)
+	require.Equal(t, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 255}, c)
+
+	c, err = ParseColor("10203040")
+	require.NoError(t, err)
+	require.Equal(t, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0x40}, c)
+
+	_, err = ParseColor("red")
+	require.Error(t, err)
+	_, err = ParseColor("gggggg")
+	require.Error(t, err)
+}
+
 func createImage(w, h int) image.Image {
 	res := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: w, Y: h}})
 	/*
@@ -0,0 +1,178 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+)
+
+const (
+	tagOrientation = 0x0112
+	typeShort      = 3
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// readEXIF возвращает данные EXIF (TIFF-структуру из сегмента APP1) JPEG-файла
+// или nil, если их нет.
+func readEXIF(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return nil
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xff: // заполнение перед маркером
+			i++
+			continue
+		case marker == 0xda || marker == 0xd9: // SOS, EOI: дальше метаданных нет
+			return nil
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7: // маркеры без длины
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil
+		}
+		if seg := b[i+4 : i+2+n]; marker == 0xe1 && bytes.HasPrefix(seg, exifHeader) {
+			return seg[len(exifHeader):]
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// orientationOffset ищет тег Orientation в IFD0 и возвращает смещение его
+// значения и порядок байт TIFF. Если тега нет, смещение равно -1.
+func orientationOffset(tiff []byte) (int, binary.ByteOrder) {
+	if len(tiff) < 8 {
+		return -1, nil
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return -1, nil
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return -1, nil
+	}
+	n := int(bo.Uint16(tiff[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) == tagOrientation && bo.Uint16(tiff[e+2:]) == typeShort {
+			return e + 8, bo
+		}
+	}
+	return -1, nil
+}
+
+// orientation возвращает значение EXIF Orientation (1..8), 1 - если оно не задано.
+func orientation(tiff []byte) int {
+	off, bo := orientationOffset(tiff)
+	if off < 0 {
+		return 1
+	}
+	if v := int(bo.Uint16(tiff[off:])); v >= 1 && v <= 8 {
+		return v
+	}
+	return 1
+}
+
+// resetOrientation возвращает копию EXIF с Orientation = 1: после orient
+// пиксели уже повернуты, и просмотрщик не должен поворачивать их еще раз.
+func resetOrientation(tiff []byte) []byte {
+	if tiff == nil {
+		return nil
+	}
+	res := append([]byte(nil), tiff...)
+	if off, bo := orientationOffset(res); off >= 0 {
+		bo.PutUint16(res[off:], 1)
+	}
+	return res
+}
+
+// orient поворачивает и отражает картинку так, чтобы она выглядела, как
+// задано EXIF Orientation o.
+func orient(m image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Rect, m, b.Min, draw.Src)
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // отражение по горизонтали
+				dx, dy = w-1-x, y
+			case 3: // поворот на 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // отражение по вертикали
+				dx, dy = x, h-1-y
+			case 5: // транспонирование
+				dx, dy = y, x
+			case 6: // поворот на 90° по часовой
+				dx, dy = h-1-y, x
+			case 7: // транспонирование по побочной диагонали
+				dx, dy = h-1-y, w-1-x
+			case 8: // поворот на 90° против часовой
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// insertJPEGEXIF добавляет сегмент APP1 с EXIF сразу после SOI.
+func insertJPEGEXIF(b []byte, tiff []byte) []byte {
+	n := 2 + len(exifHeader) + len(tiff)
+	if len(b) < 2 || n > 0xffff {
+		return b
+	}
+	res := make([]byte, 0, len(b)+2+n)
+	res = append(res, b[:2]...)
+	res = append(res, 0xff, 0xe1, byte(n>>8), byte(n))
+	res = append(res, exifHeader...)
+	res = append(res, tiff...)
+	return append(res, b[2:]...)
+}
+
+// insertPNGEXIF добавляет чанк eXIf сразу после IHDR.
+func insertPNGEXIF(b []byte, tiff []byte) []byte {
+	const ihdrEnd = 8 + 8 + 13 + 4 // сигнатура + длина и тип + данные IHDR + CRC
+	if len(b) < ihdrEnd {
+		return b
+	}
+	c := make([]byte, 8, 12+len(tiff))
+	binary.BigEndian.PutUint32(c, uint32(len(tiff)))
+	copy(c[4:], "eXIf")
+	c = append(c, tiff...)
+	c = append(c, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(c[len(c)-4:], crc32.ChecksumIEEE(c[4:len(c)-4]))
+	res := make([]byte, 0, len(b)+len(c))
+	res = append(res, b[:ihdrEnd]...)
+	res = append(res, c...)
+	return append(res, b[ihdrEnd:]...)
+}
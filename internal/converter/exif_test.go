@@ -0,0 +1,118 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+)
+
+// tiffOrientation собирает минимальный EXIF с единственным тегом Orientation.
+func tiffOrientation(bo binary.ByteOrder, o uint16) []byte {
+	b := make([]byte, 26)
+	if bo == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	bo.PutUint16(b[2:], 42)
+	bo.PutUint32(b[4:], 8)
+	bo.PutUint16(b[8:], 1)
+	bo.PutUint16(b[10:], tagOrientation)
+	bo.PutUint16(b[12:], typeShort)
+	bo.PutUint32(b[14:], 1)
+	bo.PutUint16(b[18:], o)
+	return b
+}
+
+// orientedJPEG возвращает JPEG 40x20 с красной левой и синей правой половиной и
+// заданной EXIF Orientation.
+func orientedJPEG(t *testing.T, bo binary.ByteOrder, o uint16) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{R: 0xff, A: 0xff}
+			if x >= 20 {
+				c = color.RGBA{B: 0xff, A: 0xff}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, m, &jpeg.Options{Quality: 95}))
+	return insertJPEGEXIF(buf.Bytes(), tiffOrientation(bo, o))
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xc000 && b < 0x4000
+}
+
+func TestReadEXIF(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := uint16(1); o <= 8; o++ {
+			require.Equal(t, int(o), orientation(readEXIF(orientedJPEG(t, bo, o))), bo.String())
+		}
+	}
+	require.Nil(t, readEXIF([]byte("not a jpeg")))
+	require.Equal(t, 1, orientation(nil))
+	require.Equal(t, 1, orientation(tiffOrientation(binary.BigEndian, 9)))
+}
+
+func TestSelectTypeOrientation(t *testing.T) {
+	table := []struct {
+		orientation   uint16
+		width, height int
+		redX, redY    int
+		msg           string
+	}{
+		{orientation: 1, width: 40, height: 20, redX: 5, redY: 10, msg: "Normal"},
+		{orientation: 2, width: 40, height: 20, redX: 35, redY: 10, msg: "Mirrored"},
+		{orientation: 3, width: 40, height: 20, redX: 35, redY: 10, msg: "Rotated 180"},
+		{orientation: 6, width: 20, height: 40, redX: 10, redY: 5, msg: "Rotated 90 CW"},
+		{orientation: 8, width: 20, height: 40, redX: 10, redY: 35, msg: "Rotated 90 CCW"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			res, err := SelectType(Options{Mode: ModeFit, Width: 100, Height: 100}, orientedJPEG(t, binary.BigEndian, dat.orientation))
+			require.NoError(t, err)
+			m, err := jpeg.Decode(bytes.NewReader(res))
+			require.NoError(t, err)
+			require.Equal(t, image.Rect(0, 0, dat.width, dat.height), m.Bounds())
+			require.True(t, isRed(m.At(dat.redX, dat.redY)))
+			require.Nil(t, readEXIF(res), "metadata must be stripped by default")
+		})
+	}
+}
+
+func TestSelectTypeKeepMeta(t *testing.T) {
+	src := orientedJPEG(t, binary.LittleEndian, 6)
+
+	res, err := SelectType(Options{Mode: ModeFit, Width: 100, Height: 100, KeepMeta: true}, src)
+	require.NoError(t, err)
+	exif := readEXIF(res)
+	require.NotNil(t, exif)
+	require.Equal(t, 1, orientation(exif), "pixels are already rotated")
+	m, err := jpeg.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+	require.Equal(t, 20, m.Bounds().Dx())
+
+	res, err = SelectType(Options{Mode: ModeFit, Width: 100, Height: 100, KeepMeta: true, Format: FormatPNG}, src)
+	require.NoError(t, err)
+	require.Contains(t, string(res), "eXIf")
+	_, err = png.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+
+	res, err = SelectType(Options{Mode: ModeFit, Width: 100, Height: 100, KeepMeta: true, Format: FormatWebP}, src)
+	require.NoError(t, err)
+	require.Contains(t, string(res), "EXIF")
+	_, err = webp.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+}
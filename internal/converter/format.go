@@ -0,0 +1,118 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"github.com/tiburon-777/OTUS_Project/internal/webp"
+)
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatGIF  Format = "gif"
+	FormatWebP Format = "webp"
+)
+
+const DefaultQuality = 80
+
+var (
+	ErrUnknownFormat = errors.New("unknown format")
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+// ParseFormat разбирает имя формата из параметра запроса.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+		return f, nil
+	case "jpg":
+		return FormatJPEG, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+}
+
+// DetectFormat определяет формат картинки по её содержимому. Для
+// неподдерживаемых форматов возвращается пустая строка.
+func DetectFormat(b []byte) Format {
+	switch http.DetectContentType(b) {
+	case "image/jpeg":
+		return FormatJPEG
+	case "image/png":
+		return FormatPNG
+	case "image/gif":
+		return FormatGIF
+	default:
+		return ""
+	}
+}
+
+// checkPixels по заголовку картинки проверяет, что после декодирования в ней
+// будет не больше maxPixels пикселей (0 - без ограничения). Так большие
+// картинки отбрасываются до выделения памяти под них.
+func checkPixels(b []byte, maxPixels int) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+	c, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if int64(c.Width)*int64(c.Height) > int64(maxPixels) {
+		return fmt.Errorf("%w: %dx%d", ErrTooManyPixels, c.Width, c.Height)
+	}
+	return nil
+}
+
+func decode(f Format, b []byte) (image.Image, error) {
+	tb := bytes.NewBuffer(b)
+	switch f {
+	case FormatJPEG:
+		return jpeg.Decode(tb)
+	case FormatPNG:
+		return png.Decode(tb)
+	case FormatGIF:
+		return gif.Decode(tb)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// encode кодирует картинку в формат f. Исходный формат src нужен для WebP:
+// фотографии (JPEG) сжимаются с потерями, остальное - без потерь. quality
+// влияет только на кодирование с потерями. Непустой exif записывается в
+// JPEG, PNG и WebP; в GIF его некуда положить.
+func encode(m image.Image, f Format, src Format, quality int, exif []byte) ([]byte, error) {
+	if quality <= 0 {
+		quality = DefaultQuality
+	}
+	res := bytes.NewBuffer([]byte{})
+	var err error
+	switch f {
+	case FormatJPEG:
+		if err = jpeg.Encode(res, m, &jpeg.Options{Quality: quality}); err == nil && exif != nil {
+			return insertJPEGEXIF(res.Bytes(), exif), nil
+		}
+	case FormatPNG:
+		if err = png.Encode(res, m); err == nil && exif != nil {
+			return insertPNGEXIF(res.Bytes(), exif), nil
+		}
+	case FormatGIF:
+		err = gif.Encode(res, m, nil)
+	case FormatWebP:
+		err = webp.Encode(res, m, &webp.Options{Lossless: src != FormatJPEG, Quality: float32(quality), EXIF: exif})
+	default:
+		err = ErrUnknownFormat
+	}
+	return res.Bytes(), err
+}
@@ -0,0 +1,123 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+)
+
+func TestSelectTypeFormatSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	src, err := ioutil.ReadFile("../../test/data/gopher_original_1024x504.jpg")
+	require.NoError(t, err)
+	var pngSrc bytes.Buffer
+	require.NoError(t, png.Encode(&pngSrc, createImage(40, 30)))
+
+	table := []struct {
+		src      []byte
+		format   Format
+		expected Format
+		msg      string
+	}{
+		{src: src, expected: FormatJPEG, msg: "Same format as source"},
+		{src: src, format: FormatWebP, expected: FormatWebP, msg: "JPEG to WebP"},
+		{src: src, format: FormatPNG, expected: FormatPNG, msg: "JPEG to PNG"},
+		{src: pngSrc.Bytes(), format: FormatWebP, expected: FormatWebP, msg: "PNG to WebP"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			res, err := SelectType(Options{Mode: ModeFit, Width: 20, Height: 20, Format: dat.format}, dat.src)
+			require.NoError(t, err)
+			if dat.expected != FormatWebP {
+				require.Equal(t, dat.expected, DetectFormat(res))
+				return
+			}
+			m, err := webp.Decode(bytes.NewReader(res))
+			require.NoError(t, err)
+			require.LessOrEqual(t, m.Bounds().Dx(), 20)
+			if DetectFormat(dat.src) == FormatPNG {
+				_, lossless := m.(*image.NRGBA)
+				require.True(t, lossless, "PNG must be encoded losslessly")
+			}
+		})
+	}
+
+	_, err = SelectType(Options{Mode: ModeFit, Width: 20, Height: 20}, []byte("<html></html>"))
+	require.Equal(t, ErrUnknownFormat, err)
+}
+
+func TestSelectTypeQualitySlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	src, err := ioutil.ReadFile("../../test/data/gopher_original_1024x504.jpg")
+	require.NoError(t, err)
+	for _, f := range []Format{FormatJPEG, FormatWebP} {
+		o := Options{Mode: ModeFit, Width: 300, Height: 300, Format: f}
+		o.Quality = 30
+		low, err := SelectType(o, src)
+		require.NoError(t, err)
+		o.Quality = 95
+		high, err := SelectType(o, src)
+		require.NoError(t, err)
+		require.Less(t, len(low), len(high), string(f))
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	table := []struct {
+		value    string
+		expected Format
+		err      bool
+	}{
+		{value: "webp", expected: FormatWebP},
+		{value: "PNG", expected: FormatPNG},
+		{value: "jpg", expected: FormatJPEG},
+		{value: "jpeg", expected: FormatJPEG},
+		{value: "gif", expected: FormatGIF},
+		{value: "bmp", err: true},
+		{value: "", err: true},
+	}
+
+	for _, dat := range table {
+		f, err := ParseFormat(dat.value)
+		require.Equal(t, dat.err, err != nil, dat.value)
+		require.Equal(t, dat.expected, f, dat.value)
+	}
+}
+
+func TestSelectTypePixelLimit(t *testing.T) {
+	var src bytes.Buffer
+	require.NoError(t, png.Encode(&src, createImage(100, 50)))
+
+	_, err := SelectType(Options{Mode: ModeFit, Width: 20, Height: 20, MaxPixels: 4999}, src.Bytes())
+	require.True(t, errors.Is(err, ErrTooManyPixels), err)
+
+	_, err = SelectType(Options{Mode: ModeFit, Width: 20, Height: 20, MaxPixels: 5000}, src.Bytes())
+	require.NoError(t, err)
+}
+
+func TestSelectTypePreferFallback(t *testing.T) {
+	var src bytes.Buffer
+	require.NoError(t, png.Encode(&src, createImage(20000, 2)))
+
+	// Предпочтительный WebP не кодирует такую ширину: отдается исходный формат.
+	o := Options{Mode: ModeCrop, Width: 20000, Height: 1, Prefer: FormatWebP}
+	res, err := SelectType(o, src.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, FormatPNG, DetectFormat(res))
+
+	// Явно запрошенный формат не подменяется.
+	o.Prefer, o.Format = "", FormatWebP
+	_, err = SelectType(o, src.Bytes())
+	require.Error(t, err)
+}
@@ -0,0 +1,386 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"sort"
+)
+
+var ErrTooManyFrames = errors.New("too many frames in animation")
+
+// maxSamples ограничивает число пикселей, по которым строится палитра анимации.
+const maxSamples = 1 << 18
+
+// decodeGIF декодирует все кадры GIF. Ограничения проверяются до
+// декодирования: если кадров больше maxFrames, возвращается ErrTooManyFrames,
+// если в кадрах вместе больше maxPixels пикселей холста - ErrTooManyPixels
+// (нулевые значения не ограничивают).
+func decodeGIF(b []byte, maxFrames, maxPixels int) (*gif.GIF, error) {
+	frames, screen, err := scanGIF(b)
+	if err != nil {
+		return nil, err
+	}
+	if maxFrames > 0 && frames > maxFrames {
+		return nil, ErrTooManyFrames
+	}
+	if maxPixels > 0 && int64(frames)*screen > int64(maxPixels) {
+		return nil, fmt.Errorf("%w: %d frames of %d pixels", ErrTooManyPixels, frames, screen)
+	}
+	return gif.DecodeAll(bytes.NewReader(b))
+}
+
+// scanGIF считает кадры GIF по блокам файла, не распаковывая их, и возвращает
+// их число и площадь холста. Каждый кадр при обработке собирается на полном
+// холсте, поэтому память и время растут как их произведение.
+func scanGIF(b []byte) (frames int, screen int64, err error) {
+	errMalformed := errors.New("gif: malformed file")
+	if len(b) < 13 {
+		return 0, 0, errMalformed
+	}
+	screen = int64(int(b[6])|int(b[7])<<8) * int64(int(b[8])|int(b[9])<<8)
+	pos := 13
+	if b[10]&0x80 != 0 {
+		pos += 3 << (b[10]&7 + 1)
+	}
+	// skipBlocks пропускает цепочку подблоков данных до нулевого терминатора.
+	skipBlocks := func() bool {
+		for pos < len(b) {
+			n := int(b[pos])
+			pos += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for pos < len(b) {
+		switch b[pos] {
+		case 0x21: // расширение
+			pos += 2
+			if !skipBlocks() {
+				return 0, 0, errMalformed
+			}
+		case 0x2c: // кадр
+			if pos+10 > len(b) {
+				return 0, 0, errMalformed
+			}
+			flags := b[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos++ // минимальный размер кода LZW
+			if !skipBlocks() {
+				return 0, 0, errMalformed
+			}
+			frames++
+		case 0x3b: // конец файла
+			return frames, screen, nil
+		default:
+			return 0, 0, errMalformed
+		}
+	}
+	// Файл без завершающего блока декодер принимает, если кадры целы.
+	return frames, screen, nil
+}
+
+// processAnimation обрабатывает каждый кадр анимации согласно Options. Кадры
+// GIF бывают частичными, поэтому сначала собираются на полном холсте с учетом
+// disposal, а результат кодируется полными кадрами с общей палитрой. Задержки
+// и число повторов сохраняются. Чтобы не держать в памяти все полноцветные
+// кадры результата, они обрабатываются дважды: сначала для палитры, затем для
+// перевода в нее.
+func processAnimation(g *gif.GIF, o Options) ([]byte, error) {
+	out := int64(o.Width) * int64(o.Height)
+	if screen := int64(g.Config.Width) * int64(g.Config.Height); o.Mode == ModeFit && screen < out {
+		out = screen
+	}
+	if o.MaxPixels > 0 && int64(len(g.Image))*out > int64(o.MaxPixels) {
+		return nil, fmt.Errorf("%w: %d frames of %d pixels in result", ErrTooManyPixels, len(g.Image), out)
+	}
+
+	process := func(i int, canvas *image.RGBA) (*image.NRGBA, error) {
+		frame := image.NewRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		m := NewImage(frame)
+		if i == 0 && o.Mode == ModeFill && o.Gravity == GravitySmart {
+			// Окно обрезки выбирается по первому кадру и дальше не двигается.
+			o.Gravity = m.smartGravity(o.Width, o.Height)
+		}
+		if err := m.process(o); err != nil {
+			return nil, err
+		}
+		return toNRGBA(m.Image), nil
+	}
+
+	s := &sampler{frames: len(g.Image)}
+	err := composeFrames(g, func(i int, canvas *image.RGBA) error {
+		f, err := process(i, canvas)
+		if err == nil {
+			s.add(f)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := s.quantizer()
+
+	res := &gif.GIF{
+		Image:     make([]*image.Paletted, len(g.Image)),
+		Delay:     g.Delay,
+		Disposal:  make([]byte, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+	if q.transparent >= 0 {
+		res.BackgroundIndex = uint8(q.transparent)
+	}
+	err = composeFrames(g, func(i int, canvas *image.RGBA) error {
+		f, err := process(i, canvas)
+		if err != nil {
+			return err
+		}
+		var transparent bool
+		res.Image[i], transparent = q.paletted(f)
+		res.Disposal[i] = g.Disposal[i]
+		if transparent {
+			// Кадр полный: прозрачные места не должны показывать предыдущий кадр.
+			res.Disposal[i] = gif.DisposalBackground
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := res.Image[0].Rect
+	res.Config = image.Config{ColorModel: q.palette, Width: r.Dx(), Height: r.Dy()}
+	buf := bytes.NewBuffer([]byte{})
+	if err := gif.EncodeAll(buf, res); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// composeFrames собирает кадры анимации на полном холсте с учетом disposal и
+// передает холст fn после наложения каждого кадра.
+func composeFrames(g *gif.GIF, fn func(i int, canvas *image.RGBA) error) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, p := range g.Image {
+		var saved []uint8
+		if g.Disposal[i] == gif.DisposalPrevious {
+			saved = append(saved, canvas.Pix...)
+		}
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		if err := fn(i, canvas); err != nil {
+			return err
+		}
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, saved)
+		}
+	}
+	return nil
+}
+
+// smartGravity подбирает окно обрезки так же, как convert с GravitySmart, и
+// возвращает его в виде фокусной точки, чтобы применить ко всем кадрам.
+func (img *Image) smartGravity(width, height int) Gravity {
+	if width <= 0 || height <= 0 {
+		return GravitySmart
+	}
+	sfOriginal := sizeFactor(img.Bounds().Dx(), img.Bounds().Dy())
+	sfNew := sizeFactor(width, height)
+	fx, fy := 0.5, 0.5
+	switch {
+	case sfOriginal > sfNew:
+		calcWidth := int(float64(height) * sfOriginal)
+		m := NewImage(img.Image)
+		if err := m.resize(calcWidth, height); err != nil {
+			return GravitySmart
+		}
+		x := smartCrop(m.Image, width, height).X
+		fx = (float64(x) + float64(width)/2 + 0.5) / float64(calcWidth)
+	case sfOriginal < sfNew:
+		calcHeight := int(float64(width) / sfOriginal)
+		m := NewImage(img.Image)
+		if err := m.resize(width, calcHeight); err != nil {
+			return GravitySmart
+		}
+		y := smartCrop(m.Image, width, height).Y
+		fy = (float64(y) + float64(height)/2 + 0.5) / float64(calcHeight)
+	}
+	g, err := ParseGravity(fmt.Sprintf("fp:%g,%g", math.Min(fx, 1), math.Min(fy, 1)))
+	if err != nil {
+		return GravitySmart
+	}
+	return g
+}
+
+func toNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	res := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(res, res.Rect, m, b.Min, draw.Src)
+	return res
+}
+
+// quantizer переводит кадры в общую палитру, построенную методом median cut.
+// Пиксели с альфой меньше половины считаются прозрачными и получают отдельный
+// индекс.
+type quantizer struct {
+	palette     color.Palette
+	transparent int
+	index       map[uint32]uint8
+}
+
+// sampler собирает для палитры не больше maxSamples цветов из кадров
+// результата. Все frames кадров одного размера, поэтому шаг выборки
+// определяется по первому.
+type sampler struct {
+	frames      int
+	step        int
+	n           int
+	samples     [][3]uint8
+	transparent bool
+}
+
+func (s *sampler) add(f *image.NRGBA) {
+	if s.step == 0 {
+		s.step = s.frames*len(f.Pix)/4/maxSamples + 1
+	}
+	for i := 0; i < len(f.Pix); i += 4 {
+		if f.Pix[i+3] < 0x80 {
+			s.transparent = true
+			continue
+		}
+		if s.n++; s.n%s.step == 0 {
+			s.samples = append(s.samples, [3]uint8{f.Pix[i], f.Pix[i+1], f.Pix[i+2]})
+		}
+	}
+}
+
+func (s *sampler) quantizer() *quantizer {
+	size := 256
+	q := &quantizer{transparent: -1, index: map[uint32]uint8{}}
+	if s.transparent {
+		size--
+	}
+	q.palette = medianCut(s.samples, size)
+	if s.transparent {
+		q.transparent = len(q.palette)
+		q.palette = append(q.palette, color.RGBA{})
+	}
+	return q
+}
+
+// paletted переводит кадр в палитру квантайзера и сообщает, есть ли в нем
+// прозрачные пиксели.
+func (q *quantizer) paletted(f *image.NRGBA) (*image.Paletted, bool) {
+	res := image.NewPaletted(f.Rect, q.palette)
+	var transparent bool
+	for i, j := 0, 0; i < len(f.Pix); i, j = i+4, j+1 {
+		if f.Pix[i+3] < 0x80 {
+			res.Pix[j] = uint8(q.transparent)
+			transparent = true
+			continue
+		}
+		key := uint32(f.Pix[i])<<16 | uint32(f.Pix[i+1])<<8 | uint32(f.Pix[i+2])
+		idx, ok := q.index[key]
+		if !ok {
+			idx = q.nearest(f.Pix[i], f.Pix[i+1], f.Pix[i+2])
+			q.index[key] = idx
+		}
+		res.Pix[j] = idx
+	}
+	return res, transparent
+}
+
+func (q *quantizer) nearest(r, g, b uint8) uint8 {
+	best, bestDist := 0, -1
+	for i, c := range q.palette {
+		if i == q.transparent {
+			continue
+		}
+		pc := c.(color.RGBA)
+		d := sqDiff(r, pc.R) + sqDiff(g, pc.G) + sqDiff(b, pc.B)
+		if bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return uint8(best)
+}
+
+func sqDiff(a, b uint8) int {
+	d := int(a) - int(b)
+	return d * d
+}
+
+// medianCut делит облако цветов на не более чем size групп, каждый раз
+// разрезая по медиане группу с наибольшим разбросом, и возвращает средние
+// цвета групп.
+func medianCut(samples [][3]uint8, size int) color.Palette {
+	if len(samples) == 0 {
+		return color.Palette{color.RGBA{A: 0xff}}
+	}
+	boxes := [][][3]uint8{samples}
+	for len(boxes) < size {
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			ch, r := widestChannel(box)
+			if r*len(box) > bestRange {
+				best, bestCh, bestRange = i, ch, r*len(box)
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i][bestCh] < box[j][bestCh] })
+		boxes[best] = box[:len(box)/2]
+		boxes = append(boxes, box[len(box)/2:])
+	}
+	res := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, c := range box {
+			sum[0] += int(c[0])
+			sum[1] += int(c[1])
+			sum[2] += int(c[2])
+		}
+		n := len(box)
+		res[i] = color.RGBA{R: uint8((sum[0] + n/2) / n), G: uint8((sum[1] + n/2) / n), B: uint8((sum[2] + n/2) / n), A: 0xff}
+	}
+	return res
+}
+
+func widestChannel(box [][3]uint8) (int, int) {
+	lo := [3]uint8{0xff, 0xff, 0xff}
+	var hi [3]uint8
+	for _, c := range box {
+		for ch := 0; ch < 3; ch++ {
+			if c[ch] < lo[ch] {
+				lo[ch] = c[ch]
+			}
+			if c[ch] > hi[ch] {
+				hi[ch] = c[ch]
+			}
+		}
+	}
+	best := 0
+	for ch := 1; ch < 3; ch++ {
+		if hi[ch]-lo[ch] > hi[best]-lo[best] {
+			best = ch
+		}
+	}
+	return best, int(hi[best] - lo[best])
+}
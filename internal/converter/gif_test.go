@@ -0,0 +1,163 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// animation возвращает GIF из n кадров 80x40: первый кадр полный, остальные
+// закрашивают квадрат 10x10 в своей позиции.
+func animation(t *testing.T, n int, transparent bool) []byte {
+	pal := color.Palette{color.White, color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}, color.Transparent}
+	g := &gif.GIF{LoopCount: 3}
+	for i := 0; i < n; i++ {
+		r := image.Rect(0, 0, 80, 40)
+		if i > 0 {
+			r = image.Rect(i*10%70, 10, i*10%70+10, 20)
+		}
+		m := image.NewPaletted(r, pal)
+		for j := range m.Pix {
+			m.Pix[j] = uint8(1 + i%2)
+		}
+		if i == 0 {
+			for j := range m.Pix {
+				m.Pix[j] = 0
+				if transparent && j%80 < 40 {
+					m.Pix[j] = 3
+				}
+			}
+		}
+		g.Image = append(g.Image, m)
+		g.Delay = append(g.Delay, 10+i)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+func TestSelectTypeAnimation(t *testing.T) {
+	table := []struct {
+		opts   Options
+		width  int
+		height int
+		msg    string
+	}{
+		{opts: Options{Mode: ModeFit, Width: 40, Height: 40}, width: 40, height: 20, msg: "Fit"},
+		{opts: Options{Mode: ModeFill, Width: 20, Height: 20, Gravity: GravitySmart}, width: 20, height: 20, msg: "Fill with smart gravity"},
+		{opts: Options{Mode: ModeFitIn, Width: 50, Height: 50, Background: color.NRGBA{A: 0xff}}, width: 50, height: 50, msg: "Fit-in"},
+		{opts: Options{Mode: ModeCrop, X: 10, Y: 5, Width: 30, Height: 30, Format: FormatGIF}, width: 30, height: 30, msg: "Crop to explicit GIF"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			res, err := SelectType(dat.opts, animation(t, 5, false))
+			require.NoError(t, err)
+			g, err := gif.DecodeAll(bytes.NewReader(res))
+			require.NoError(t, err)
+			require.Len(t, g.Image, 5)
+			require.Equal(t, []int{10, 11, 12, 13, 14}, g.Delay)
+			require.Equal(t, 3, g.LoopCount)
+			require.Equal(t, dat.width, g.Config.Width)
+			require.Equal(t, dat.height, g.Config.Height)
+			for _, m := range g.Image {
+				require.Equal(t, image.Rect(0, 0, dat.width, dat.height), m.Bounds())
+			}
+		})
+	}
+}
+
+func TestSelectTypeAnimationFrames(t *testing.T) {
+	src := animation(t, 4, false)
+	res, err := SelectType(Options{Mode: ModeStretch, Width: 80, Height: 40}, src)
+	require.NoError(t, err)
+	g, err := gif.DecodeAll(bytes.NewReader(res))
+	require.NoError(t, err)
+	// Частичные кадры собираются на холсте: квадраты прошлых кадров остаются.
+	last := g.Image[3]
+	require.Equal(t, color.RGBA{B: 0xff, A: 0xff}, color.RGBAModel.Convert(last.At(15, 15)))
+	require.Equal(t, color.RGBA{R: 0xff, A: 0xff}, color.RGBAModel.Convert(last.At(25, 15)))
+	require.Equal(t, color.RGBA{B: 0xff, A: 0xff}, color.RGBAModel.Convert(last.At(35, 15)))
+	require.Equal(t, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, color.RGBAModel.Convert(last.At(5, 35)))
+}
+
+func TestSelectTypeAnimationTransparent(t *testing.T) {
+	res, err := SelectType(Options{Mode: ModeStretch, Width: 80, Height: 40}, animation(t, 3, true))
+	require.NoError(t, err)
+	g, err := gif.DecodeAll(bytes.NewReader(res))
+	require.NoError(t, err)
+	for i, m := range g.Image {
+		_, _, _, a := m.At(5, 30).RGBA()
+		require.Zero(t, a)
+		require.Equal(t, byte(gif.DisposalBackground), g.Disposal[i])
+	}
+}
+
+func TestSelectTypeAnimationLimits(t *testing.T) {
+	src := animation(t, 6, false)
+	_, err := SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, MaxFrames: 5}, src)
+	require.Equal(t, ErrTooManyFrames, err)
+
+	_, err = SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, MaxFrames: 6}, src)
+	require.NoError(t, err)
+
+	// Холст 80x40 пропускается проверкой одной картинки, но не шестью кадрами.
+	_, err = SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, MaxPixels: 6*80*40 - 1}, src)
+	require.True(t, errors.Is(err, ErrTooManyPixels), err)
+	_, err = SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, MaxPixels: 6 * 80 * 40}, src)
+	require.NoError(t, err)
+
+	// Кадры результата тоже входят в бюджет: 6 кадров 400x400 больше 6*80*40.
+	_, err = SelectType(Options{Mode: ModeFill, Width: 400, Height: 400, Gravity: GravityCenter, MaxPixels: 6 * 80 * 40}, src)
+	require.True(t, errors.Is(err, ErrTooManyPixels), err)
+	_, err = SelectType(Options{Mode: ModeFill, Width: 400, Height: 400, Gravity: GravityCenter, MaxPixels: 6 * 400 * 400}, src)
+	require.NoError(t, err)
+
+	// Явно запрошенный статичный формат берет первый кадр, не ограничивая их число.
+	res, err := SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, Format: FormatPNG, MaxFrames: 5}, src)
+	require.NoError(t, err)
+	m, err := png.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+	require.Equal(t, 40, m.Bounds().Dx())
+
+	// Предпочтительный формат (из Accept) анимацию не отменяет.
+	res, err = SelectType(Options{Mode: ModeFit, Width: 40, Height: 40, Prefer: FormatWebP}, src)
+	require.NoError(t, err)
+	require.Equal(t, FormatGIF, DetectFormat(res))
+}
+
+func TestScanGIF(t *testing.T) {
+	src := animation(t, 7, true)
+	frames, screen, err := scanGIF(src)
+	require.NoError(t, err)
+	require.Equal(t, 7, frames)
+	require.Equal(t, int64(80*40), screen)
+
+	// Локальные палитры и расширения кадров пропускаются.
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{LoopCount: -1}
+	for i := 0; i < 3; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), append(color.Palette{color.Transparent}, pal[i%2])))
+		g.Delay = append(g.Delay, 5)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buf, g))
+	frames, screen, err = scanGIF(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 3, frames)
+	require.Equal(t, int64(16), screen)
+
+	unknown := append([]byte{}, src[:13]...)
+	unknown[10] &^= 0x80
+	for _, b := range [][]byte{nil, src[:12], src[:len(src)/2], append(unknown, 0x00)} {
+		_, _, err = scanGIF(b)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,90 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Gravity задает, какая часть изображения сохраняется при обрезке в режиме fill.
+// Кроме именованных значений допускается фокусная точка "fp:x,y", где x и y - доли
+// ширины и высоты от 0 до 1.
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravitySouth     Gravity = "south"
+	GravityEast      Gravity = "east"
+	GravityWest      Gravity = "west"
+	GravityNorthEast Gravity = "northeast"
+	GravityNorthWest Gravity = "northwest"
+	GravitySouthEast Gravity = "southeast"
+	GravitySouthWest Gravity = "southwest"
+	GravitySmart     Gravity = "smart" // положение окна подбирается по содержимому, см. smartCrop
+)
+
+var gravityPoints = map[Gravity][2]float64{
+	"":               {0.5, 0.5},
+	GravityCenter:    {0.5, 0.5},
+	GravityNorth:     {0.5, 0},
+	GravitySouth:     {0.5, 1},
+	GravityEast:      {1, 0.5},
+	GravityWest:      {0, 0.5},
+	GravityNorthEast: {1, 0},
+	GravityNorthWest: {0, 0},
+	GravitySouthEast: {1, 1},
+	GravitySouthWest: {0, 1},
+	GravitySmart:     {0.5, 0.5},
+}
+
+// ParseGravity проверяет значение gravity и приводит его к каноническому виду.
+func ParseGravity(s string) (Gravity, error) {
+	g := Gravity(strings.ToLower(s))
+	if _, ok := gravityPoints[g]; ok && g != "" {
+		return g, nil
+	}
+	if !strings.HasPrefix(string(g), "fp:") {
+		return "", fmt.Errorf("unknown gravity %q", s)
+	}
+	x, y, err := g.focalPoint()
+	if err != nil {
+		return "", err
+	}
+	return Gravity("fp:" + strconv.FormatFloat(x, 'g', -1, 64) + "," + strconv.FormatFloat(y, 'g', -1, 64)), nil
+}
+
+// focalPoint возвращает точку (в долях размера изображения), вокруг которой
+// центрируется область обрезки.
+func (g Gravity) focalPoint() (float64, float64, error) {
+	if p, ok := gravityPoints[g]; ok {
+		return p[0], p[1], nil
+	}
+	if !strings.HasPrefix(string(g), "fp:") {
+		return 0, 0, fmt.Errorf("unknown gravity %q", string(g))
+	}
+	xy := strings.Split(strings.TrimPrefix(string(g), "fp:"), ",")
+	if len(xy) != 2 {
+		return 0, 0, fmt.Errorf("not valid focal point %q", string(g))
+	}
+	x, errX := strconv.ParseFloat(xy[0], 64)
+	y, errY := strconv.ParseFloat(xy[1], 64)
+	if errX != nil || errY != nil || math.IsNaN(x) || math.IsNaN(y) || x < 0 || x > 1 || y < 0 || y > 1 {
+		return 0, 0, fmt.Errorf("not valid focal point %q", string(g))
+	}
+	return x, y, nil
+}
+
+// cropOffset возвращает смещение окна size внутри отрезка length так, чтобы
+// точка focal (доля length) оказалась как можно ближе к центру окна.
+func cropOffset(length, size int, focal float64) int {
+	offset := int(math.Floor(focal*float64(length) - float64(size)/2))
+	if offset > length-size {
+		offset = length - size
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
@@ -0,0 +1,83 @@
+package converter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGravity(t *testing.T) {
+	table := []struct {
+		value    string
+		expected Gravity
+		err      bool
+		msg      string
+	}{
+		{value: "north", expected: GravityNorth, msg: "Named gravity"},
+		{value: "SouthWest", expected: GravitySouthWest, msg: "Case insensitive"},
+		{value: "fp:0.25,1", expected: "fp:0.25,1", msg: "Focal point"},
+		{value: "fp:0.50,0.0", expected: "fp:0.5,0", msg: "Focal point is normalized"},
+		{value: "fp:1.5,0", err: true, msg: "Focal point out of range"},
+		{value: "fp:0.5", err: true, msg: "Focal point without y"},
+		{value: "fp:NaN,0.5", err: true, msg: "Focal point is not a number"},
+		{value: "fp:0.5,nan", err: true, msg: "Focal point y is not a number"},
+		{value: "top", err: true, msg: "Unknown gravity"},
+		{value: "", err: true, msg: "Empty gravity"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			g, err := ParseGravity(dat.value)
+			require.Equal(t, dat.err, err != nil, dat.msg)
+			require.Equal(t, dat.expected, g, dat.msg)
+		})
+	}
+}
+
+func TestCropOffset(t *testing.T) {
+	require.Equal(t, 50, cropOffset(200, 100, 0.5))
+	require.Equal(t, 0, cropOffset(200, 100, 0))
+	require.Equal(t, 100, cropOffset(200, 100, 1))
+	require.Equal(t, 30, cropOffset(200, 100, 0.4))
+	require.Equal(t, 0, cropOffset(100, 100, 0.9))
+}
+
+func TestConvertGravity(t *testing.T) {
+	// Верхняя треть красная, средняя зеленая, нижняя синяя
+	red, green, blue := color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	stripes := func() image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 90, 90))
+		draw.Draw(img, image.Rect(0, 0, 90, 30), image.NewUniform(red), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(0, 30, 90, 60), image.NewUniform(green), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(0, 60, 90, 90), image.NewUniform(blue), image.Point{}, draw.Src)
+		return img
+	}
+
+	table := []struct {
+		gravity  Gravity
+		expected color.RGBA
+		msg      string
+	}{
+		{gravity: GravityNorth, expected: red, msg: "North"},
+		{gravity: GravityNorthEast, expected: red, msg: "North-east"},
+		{gravity: GravityCenter, expected: green, msg: "Center"},
+		{gravity: GravityWest, expected: green, msg: "West keeps vertical center"},
+		{gravity: GravitySouth, expected: blue, msg: "South"},
+		{gravity: "fp:0.5,0.7", expected: blue, msg: "Focal point"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			img := Image{Image: stripes()}
+			require.NoError(t, img.convert(90, 30, dat.gravity))
+			require.Equal(t, image.Rect(0, 0, 90, 30), img.Bounds())
+			require.Equal(t, dat.expected, color.RGBAModel.Convert(img.At(45, 15)))
+		})
+	}
+
+	img := Image{Image: stripes()}
+	require.Error(t, img.convert(90, 30, "fp:2,2"))
+}
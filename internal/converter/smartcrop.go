@@ -0,0 +1,171 @@
+package converter
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	smartSampleSize       = 256  // по большей стороне анализируется не больше smartSampleSize точек
+	smartSteps            = 64   // максимальное число пробных положений окна по каждой оси
+	smartSaturationWeight = 0.5  // вклад насыщенности относительно плотности границ
+	smartSaliencyWeight   = 0.5  // вклад отличия цвета клетки от среднего цвета изображения
+	smartEntropyWeight    = 0.05 // вклад энтропии яркости (в битах) в оценку окна
+	smartCenterWeight     = 0.05 // штраф за удаленность окна от центра, разрешает "ничьи" в пользу центра
+	smartLumaBins         = 16
+)
+
+// energyMap - уменьшенная карта "интересности" изображения: каждая клетка сетки
+// соответствует квадрату step x step исходных точек.
+type energyMap struct {
+	w, h     int
+	step     int
+	integral []float64 // суммы энергии по прямоугольникам (0,0)-(x,y), размер (w+1)*(h+1)
+	luma     []uint8   // номер корзины гистограммы яркости для каждой клетки
+}
+
+// smartCrop выбирает положение окна width x height внутри img, в котором больше всего
+// деталей: оценка окна складывается из плотности границ (перепадов яркости),
+// насыщенности цвета и энтропии гистограммы яркости. Возвращает левый верхний угол окна
+// в координатах img.
+func smartCrop(img image.Image, width, height int) image.Point {
+	b := img.Bounds()
+	if width >= b.Dx() && height >= b.Dy() {
+		return b.Min
+	}
+	m := newEnergyMap(img)
+	ww := clamp(int(math.Round(float64(width)/float64(m.step))), 1, m.w)
+	wh := clamp(int(math.Round(float64(height)/float64(m.step))), 1, m.h)
+
+	best, bestScore := image.Point{}, math.Inf(-1)
+	for _, y := range positions(m.h-wh, smartSteps) {
+		for _, x := range positions(m.w-ww, smartSteps) {
+			score := m.score(x, y, ww, wh)
+			if score > bestScore {
+				best, bestScore = image.Point{X: x, Y: y}, score
+			}
+		}
+	}
+	return image.Point{
+		X: b.Min.X + clamp(best.X*m.step, 0, b.Dx()-width),
+		Y: b.Min.Y + clamp(best.Y*m.step, 0, b.Dy()-height),
+	}
+}
+
+func newEnergyMap(img image.Image) *energyMap {
+	b := img.Bounds()
+	step := int(math.Ceil(float64(max(b.Dx(), b.Dy())) / smartSampleSize))
+	if step < 1 {
+		step = 1
+	}
+	m := &energyMap{w: (b.Dx() + step - 1) / step, h: (b.Dy() + step - 1) / step, step: step}
+	luma := make([]float64, m.w*m.h)
+	chroma := make([]float64, m.w*m.h)
+	rgb := make([][3]float64, m.w*m.h)
+	var mean [3]float64
+	m.luma = make([]uint8, m.w*m.h)
+	for y := 0; y < m.h; y++ {
+		for x := 0; x < m.w; x++ {
+			i := y*m.w + x
+			rgb[i] = cellColor(img, image.Rect(x*step, y*step, (x+1)*step, (y+1)*step).Add(b.Min).Intersect(b))
+			fr, fg, fb := rgb[i][0], rgb[i][1], rgb[i][2]
+			luma[i] = 0.299*fr + 0.587*fg + 0.114*fb
+			chroma[i] = math.Max(fr, math.Max(fg, fb)) - math.Min(fr, math.Min(fg, fb))
+			m.luma[i] = uint8(math.Min(luma[i]*smartLumaBins, smartLumaBins-1))
+			for c := range mean {
+				mean[c] += rgb[i][c] / float64(m.w*m.h)
+			}
+		}
+	}
+	m.integral = make([]float64, (m.w+1)*(m.h+1))
+	for y := 0; y < m.h; y++ {
+		var row float64
+		for x := 0; x < m.w; x++ {
+			i := y*m.w + x
+			edge := math.Abs(luma[i]-luma[y*m.w+min(x+1, m.w-1)]) + math.Abs(luma[i]-luma[min(y+1, m.h-1)*m.w+x])
+			saliency := math.Sqrt(sq(rgb[i][0]-mean[0]) + sq(rgb[i][1]-mean[1]) + sq(rgb[i][2]-mean[2]))
+			row += edge + smartSaturationWeight*chroma[i] + smartSaliencyWeight*saliency
+			m.integral[(y+1)*(m.w+1)+x+1] = m.integral[y*(m.w+1)+x+1] + row
+		}
+	}
+	return m
+}
+
+// cellColor возвращает средний цвет области r (по выборке не более 4x4 точек) в долях от 0 до 1.
+func cellColor(img image.Image, r image.Rectangle) [3]float64 {
+	var res [3]float64
+	n := 0
+	sx, sy := max(r.Dx()/4, 1), max(r.Dy()/4, 1)
+	for y := r.Min.Y + sy/2; y < r.Max.Y; y += sy {
+		for x := r.Min.X + sx/2; x < r.Max.X; x += sx {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			res[0] += float64(cr) / 0xffff
+			res[1] += float64(cg) / 0xffff
+			res[2] += float64(cb) / 0xffff
+			n++
+		}
+	}
+	for c := range res {
+		res[c] /= float64(n)
+	}
+	return res
+}
+
+// score оценивает окно ww x wh клеток с левым верхним углом в клетке (x, y).
+func (m *energyMap) score(x, y, ww, wh int) float64 {
+	stride := m.w + 1
+	sum := m.integral[(y+wh)*stride+x+ww] - m.integral[y*stride+x+ww] - m.integral[(y+wh)*stride+x] + m.integral[y*stride+x]
+	density := sum / float64(ww*wh)
+
+	var hist [smartLumaBins]int
+	for cy := y; cy < y+wh; cy++ {
+		for cx := x; cx < x+ww; cx++ {
+			hist[m.luma[cy*m.w+cx]]++
+		}
+	}
+	var entropy float64
+	for _, n := range hist {
+		if n > 0 {
+			p := float64(n) / float64(ww*wh)
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	dx := (float64(x)+float64(ww)/2)/float64(m.w) - 0.5
+	dy := (float64(y)+float64(wh)/2)/float64(m.h) - 0.5
+	return density + smartEntropyWeight*entropy - smartCenterWeight*math.Hypot(dx, dy)
+}
+
+// positions возвращает не больше steps+1 равномерно распределенных смещений от 0 до last включительно.
+func positions(last, steps int) []int {
+	if last <= 0 {
+		return []int{0}
+	}
+	stride := (last + steps - 1) / steps
+	res := make([]int, 0, last/stride+2)
+	for p := 0; p < last; p += stride {
+		res = append(res, p)
+	}
+	return append(res, last)
+}
+
+func sq(v float64) float64 {
+	return v * v
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,85 @@
+package converter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestImage(t *testing.T, name string) image.Image {
+	f, err := os.Open("../../test/data/" + name)
+	require.NoError(t, err)
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	require.NoError(t, err)
+	return img
+}
+
+func TestSmartCropSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	// Суслик на gopher_original_1024x504.jpg занимает по горизонтали полосу примерно 445-605px,
+	// на производных от него картинках - пропорционально смещенную полосу.
+	table := []struct {
+		file     string
+		width    int
+		height   int
+		expected image.Point
+		subject  [2]int
+		msg      string
+	}{
+		{
+			file: "gopher_original_1024x504.jpg", width: 204, height: 504, expected: image.Point{X: 432}, subject: [2]int{445, 605}, msg: "Narrow window",
+		},
+		{
+			file: "gopher_original_1024x504.jpg", width: 341, height: 504, expected: image.Point{X: 444}, subject: [2]int{445, 605}, msg: "Third of width",
+		},
+		{
+			file: "gopher_2000x1000.jpg", width: 400, height: 1000, expected: image.Point{X: 864}, subject: [2]int{870, 1190}, msg: "Large image",
+		},
+		{
+			file: "gopher_1024x252.jpg", width: 204, height: 252, expected: image.Point{X: 432}, subject: [2]int{445, 605}, msg: "Wide image",
+		},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			p := smartCrop(loadTestImage(t, dat.file), dat.width, dat.height)
+			require.Equal(t, dat.expected, p, dat.msg)
+			require.LessOrEqual(t, p.X, dat.subject[0], dat.msg)
+			require.GreaterOrEqual(t, p.X+dat.width, dat.subject[1], dat.msg)
+		})
+	}
+}
+
+func TestSmartCropUniform(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{Y: 128}), image.Point{}, draw.Src)
+	require.Equal(t, image.Point{X: 100}, smartCrop(img, 100, 100), "Without details window stays in the center")
+
+	// Детали (шахматная доска) только в правой трети
+	for x := 200; x < 300; x++ {
+		for y := 0; y < 100; y++ {
+			if (x/10+y/10)%2 == 0 {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	require.Equal(t, image.Point{X: 200}, smartCrop(img, 100, 100))
+	require.Equal(t, image.Point{}, smartCrop(img, 300, 100), "Window of the image size")
+}
+
+func TestConvertSmartSlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	img := Image{Image: loadTestImage(t, "gopher_original_1024x504.jpg")}
+	require.NoError(t, img.convert(300, 300, GravitySmart))
+	require.Equal(t, image.Rect(0, 0, 300, 300), img.Bounds())
+}
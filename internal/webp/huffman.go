@@ -0,0 +1,127 @@
+package webp
+
+import "sort"
+
+// huffmanCode - канонический префиксный код VP8L. Если используется только
+// один символ, он кодируется нулём бит.
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint16
+	single  bool
+}
+
+func newHuffmanCode(hist []uint32, maxLength int) huffmanCode {
+	lengths := huffmanLengths(hist, maxLength)
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	return huffmanCode{lengths: lengths, codes: canonicalCodes(lengths), single: used <= 1}
+}
+
+func (h *huffmanCode) write(bw *bitWriter, symbol int) {
+	if h.single {
+		return
+	}
+	bw.writeCode(uint32(h.codes[symbol]), uint(h.lengths[symbol]))
+}
+
+// huffmanLengths строит длины кодов по гистограмме. Если самый длинный код
+// превышает maxLength, гистограмма сглаживается и код строится заново.
+func huffmanLengths(hist []uint32, maxLength int) []uint8 {
+	counts := make([]uint32, len(hist))
+	copy(counts, hist)
+	for {
+		lengths, longest := buildLengths(counts)
+		if longest <= maxLength {
+			return lengths
+		}
+		for i, c := range counts {
+			if c > 0 {
+				counts[i] = c/2 + 1
+			}
+		}
+	}
+}
+
+func buildLengths(counts []uint32) ([]uint8, int) {
+	type node struct {
+		weight      uint64
+		left, right int
+		symbol      int
+	}
+	lengths := make([]uint8, len(counts))
+	var nodes []node
+	for s, c := range counts {
+		if c > 0 {
+			nodes = append(nodes, node{weight: uint64(c), left: -1, right: -1, symbol: s})
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return lengths, 0
+	case 1:
+		lengths[nodes[0].symbol] = 1
+		return lengths, 1
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// Две очереди: отсортированные листья и внутренние узлы, которые
+	// появляются в порядке неубывания веса.
+	leaves := len(nodes)
+	var queue []int
+	li, qi := 0, 0
+	pop := func() int {
+		if li < leaves && (qi >= len(queue) || nodes[li].weight <= nodes[queue[qi]].weight) {
+			li++
+			return li - 1
+		}
+		qi++
+		return queue[qi-1]
+	}
+	for i := 0; i < leaves-1; i++ {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b, symbol: -1})
+		queue = append(queue, len(nodes)-1)
+	}
+
+	longest := 0
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].symbol >= 0 {
+			lengths[nodes[n].symbol] = uint8(depth)
+			if depth > longest {
+				longest = depth
+			}
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return lengths, longest
+}
+
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]uint16
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [16]uint16
+	code := uint16(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,737 @@
+package webp
+
+import (
+	"image"
+	"math"
+)
+
+// Lossy-кодирование VP8 (RFC 6386): только ключевой кадр, предсказание
+// 16x16 для яркости и 8x8 для цветности, без фильтра деблокинга. Вероятности
+// токенов обновляются по статистике кадра.
+
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+)
+
+const (
+	planeY1WithY2 = iota
+	planeY2
+	planeUV
+
+	uniformProb = 128
+	nTokenProbs = nPlane * nBand * nContext * nProb
+)
+
+var (
+	bands   = [17]uint8{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	zigzag  = [16]uint8{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	cat3456 = [4][]uint8{
+		{173, 148, 140},
+		{176, 155, 140, 135},
+		{180, 157, 141, 134, 130},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+	}
+)
+
+// boolEncoder - арифметический кодер из раздела 7.3 RFC 6386.
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *boolEncoder) addOne() {
+	i := len(e.out) - 1
+	for i >= 0 && e.out[i] == 255 {
+		e.out[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.out[i]++
+	}
+}
+
+func (e *boolEncoder) writeBool(prob uint8, b bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if b {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+func (e *boolEncoder) writeUint(v uint32, n int) {
+	for n > 0 {
+		n--
+		e.writeBool(uniformProb, v>>uint(n)&1 == 1)
+	}
+}
+
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.addOne()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
+
+// tokenBit - записанное решение кодера токенов. Если slot < 0, бит кодируется
+// с фиксированной вероятностью prob, иначе с вероятностью из таблицы токенов.
+type tokenBit struct {
+	slot int16
+	prob uint8
+	bit  bool
+}
+
+type quant struct {
+	y1, y2, uv [2]int32
+}
+
+type nzState struct {
+	y16  uint8
+	mask [8]uint8 // 4 для яркости, 2+2 для цветности
+}
+
+type vp8Encoder struct {
+	mbw, mbh   int
+	src, recon *image.YCbCr
+	q          quant
+	up         []nzState
+	left       nzState
+	modes      [][2]uint8
+	bits       []tokenBit
+	stats      [nTokenProbs][2]uint32
+}
+
+func qualityToIndex(quality float32) int {
+	if quality < 0 {
+		quality = 0
+	}
+	if quality > 100 {
+		quality = 100
+	}
+	return int(math.Round(float64(100-quality) * 127 / 100))
+}
+
+func newQuant(qi int) quant {
+	var q quant
+	q.y1[0] = int32(dequantTableDC[qi])
+	q.y1[1] = int32(dequantTableAC[qi])
+	q.y2[0] = int32(dequantTableDC[qi]) * 2
+	q.y2[1] = int32(dequantTableAC[qi]) * 155 / 100
+	if q.y2[1] < 8 {
+		q.y2[1] = 8
+	}
+	uvDC := qi
+	if uvDC > 117 {
+		uvDC = 117
+	}
+	q.uv[0] = int32(dequantTableDC[uvDC])
+	q.uv[1] = int32(dequantTableAC[qi])
+	return q
+}
+
+// encodeVP8 кодирует кадр VP8 и возвращает также восстановленное декодером
+// изображение.
+func encodeVP8(img *image.NRGBA, quality float32) ([]byte, *image.YCbCr) {
+	b := img.Bounds()
+	e := &vp8Encoder{
+		mbw: (b.Dx() + 15) >> 4,
+		mbh: (b.Dy() + 15) >> 4,
+	}
+	qi := qualityToIndex(quality)
+	e.q = newQuant(qi)
+	e.src = toYCbCr(img, e.mbw, e.mbh)
+	e.recon = image.NewYCbCr(image.Rect(0, 0, 16*e.mbw, 16*e.mbh), image.YCbCrSubsampleRatio420)
+	e.up = make([]nzState, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		e.left = nzState{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	probs, updates := e.tokenProbs()
+	fp := newBoolEncoder()
+	fp.writeBool(uniformProb, false) // цветовое пространство
+	fp.writeBool(uniformProb, false) // ограничение значений
+	fp.writeBool(uniformProb, false) // сегментация
+	fp.writeBool(uniformProb, false) // обычный фильтр
+	fp.writeUint(0, 6)               // уровень фильтра
+	fp.writeUint(0, 3)               // резкость
+	fp.writeBool(uniformProb, false) // дельты фильтра
+	fp.writeUint(0, 2)               // один раздел токенов
+	fp.writeUint(uint32(qi), 7)
+	for i := 0; i < 5; i++ {
+		fp.writeBool(uniformProb, false) // дельты квантования
+	}
+	fp.writeBool(uniformProb, false) // refresh_entropy_probs
+	for i, upd := range flatProbs(&tokenProbUpdateProb) {
+		fp.writeBool(upd, updates[i])
+		if updates[i] {
+			fp.writeUint(uint32(probs[i]), 8)
+		}
+	}
+	fp.writeBool(uniformProb, false) // mb_no_coeff_skip
+	for _, m := range e.modes {
+		fp.writeBool(145, true)
+		switch m[0] {
+		case predDC:
+			fp.writeBool(156, false)
+			fp.writeBool(163, false)
+		case predVE:
+			fp.writeBool(156, false)
+			fp.writeBool(163, true)
+		case predHE:
+			fp.writeBool(156, true)
+			fp.writeBool(128, false)
+		case predTM:
+			fp.writeBool(156, true)
+			fp.writeBool(128, true)
+		}
+		switch m[1] {
+		case predDC:
+			fp.writeBool(142, false)
+		case predVE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, false)
+		case predHE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, false)
+		case predTM:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, true)
+		}
+	}
+	first := fp.flush()
+
+	tp := newBoolEncoder()
+	for _, t := range e.bits {
+		if t.slot < 0 {
+			tp.writeBool(t.prob, t.bit)
+		} else {
+			tp.writeBool(probs[t.slot], t.bit)
+		}
+	}
+	tokens := tp.flush()
+
+	out := make([]byte, 0, 10+len(first)+len(tokens))
+	tag := uint32(len(first))<<5 | 1<<4 // ключевой кадр, версия 0, show_frame
+	out = append(out, byte(tag), byte(tag>>8), byte(tag>>16))
+	out = append(out, 0x9d, 0x01, 0x2a)
+	out = append(out, byte(b.Dx()), byte(b.Dx()>>8), byte(b.Dy()), byte(b.Dy()>>8))
+	out = append(out, first...)
+	out = append(out, tokens...)
+	return out, e.recon.SubImage(image.Rect(0, 0, b.Dx(), b.Dy())).(*image.YCbCr)
+}
+
+func flatProbs(p *[nPlane][nBand][nContext][nProb]uint8) []uint8 {
+	flat := make([]uint8, 0, nTokenProbs)
+	for i := range p {
+		for j := range p[i] {
+			for k := range p[i][j] {
+				flat = append(flat, p[i][j][k][:]...)
+			}
+		}
+	}
+	return flat
+}
+
+// tokenProbs выбирает вероятности токенов по собранной статистике: значение
+// обновляется, только если это сокращает размер кадра.
+func (e *vp8Encoder) tokenProbs() ([]uint8, []bool) {
+	probs := flatProbs(&defaultTokenProb)
+	upd := flatProbs(&tokenProbUpdateProb)
+	updates := make([]bool, nTokenProbs)
+	for i, s := range e.stats {
+		total := s[0] + s[1]
+		if total == 0 {
+			continue
+		}
+		p := int(math.Round(float64(s[0]) * 256 / float64(total)))
+		if p < 1 {
+			p = 1
+		}
+		if p > 255 {
+			p = 255
+		}
+		oldCost := bitCost(probs[i], s) + probCost(upd[i], false)
+		newCost := bitCost(uint8(p), s) + probCost(upd[i], true) + 8
+		if newCost < oldCost {
+			probs[i] = uint8(p)
+			updates[i] = true
+		}
+	}
+	return probs, updates
+}
+
+func bitCost(prob uint8, s [2]uint32) float64 {
+	return float64(s[0])*probCost(prob, false) + float64(s[1])*probCost(prob, true)
+}
+
+func probCost(prob uint8, bit bool) float64 {
+	p := float64(prob) / 256
+	if bit {
+		p = 1 - p
+	}
+	return -math.Log2(p)
+}
+
+func (e *vp8Encoder) put(plane, band, ctx, i int, bit bool) {
+	slot := ((plane*nBand+band)*nContext+ctx)*nProb + i
+	e.bits = append(e.bits, tokenBit{slot: int16(slot), bit: bit})
+	if bit {
+		e.stats[slot][1]++
+	} else {
+		e.stats[slot][0]++
+	}
+}
+
+func (e *vp8Encoder) putFixed(prob uint8, bit bool) {
+	e.bits = append(e.bits, tokenBit{slot: -1, prob: prob, bit: bit})
+}
+
+// putCoeffs записывает токены блока 4x4 (раздел 13) и возвращает 1, если в
+// нём есть ненулевые коэффициенты.
+func (e *vp8Encoder) putCoeffs(levels *[16]int32, plane int, ctx uint8, first int) uint8 {
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[zigzag[n]] != 0 {
+			last = n
+		}
+	}
+	band, c := int(bands[first]), int(ctx)
+	if last < 0 {
+		e.put(plane, band, c, 0, false)
+		return 0
+	}
+	e.put(plane, band, c, 0, true)
+	for n := first; n < 16; n++ {
+		v := levels[zigzag[n]]
+		sign := v < 0
+		if sign {
+			v = -v
+		}
+		next := int(bands[n+1])
+		if v == 0 {
+			e.put(plane, band, c, 1, false)
+			band, c = next, 0
+			continue
+		}
+		e.put(plane, band, c, 1, true)
+		if v == 1 {
+			e.put(plane, band, c, 2, false)
+			band, c = next, 1
+		} else {
+			e.put(plane, band, c, 2, true)
+			e.putLevel(plane, band, c, v)
+			band, c = next, 2
+		}
+		e.putFixed(uniformProb, sign)
+		if n == 15 {
+			return 1
+		}
+		if n == last {
+			e.put(plane, band, c, 0, false)
+			return 1
+		}
+		e.put(plane, band, c, 0, true)
+	}
+	return 1
+}
+
+func (e *vp8Encoder) putLevel(plane, band, c int, v int32) {
+	switch {
+	case v <= 4:
+		e.put(plane, band, c, 3, false)
+		if v == 2 {
+			e.put(plane, band, c, 4, false)
+		} else {
+			e.put(plane, band, c, 4, true)
+			e.put(plane, band, c, 5, v == 4)
+		}
+	case v <= 10:
+		e.put(plane, band, c, 3, true)
+		e.put(plane, band, c, 6, false)
+		if v <= 6 {
+			e.put(plane, band, c, 7, false)
+			e.putFixed(159, v == 6)
+		} else {
+			e.put(plane, band, c, 7, true)
+			e.putFixed(165, (v-7)>>1 == 1)
+			e.putFixed(145, (v-7)&1 == 1)
+		}
+	default:
+		e.put(plane, band, c, 3, true)
+		e.put(plane, band, c, 6, true)
+		cat := 3
+		for cat > 0 && v < 3+8<<uint(cat) {
+			cat--
+		}
+		e.put(plane, band, c, 8, cat >= 2)
+		e.put(plane, band, c, 9+cat>>1, cat&1 == 1)
+		extra := v - (3 + 8<<uint(cat))
+		tab := cat3456[cat]
+		for i, p := range tab {
+			e.putFixed(p, extra>>uint(len(tab)-1-i)&1 == 1)
+		}
+	}
+}
+
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	var (
+		top, left [16]uint8
+		corner    uint8
+		pred      [16 * 16]uint8
+		best      [16 * 16]uint8
+	)
+	ys, cs := e.src.YStride, e.src.CStride
+
+	// Яркость: выбор режима по сумме абсолютных отклонений.
+	e.edges(e.recon.Y, ys, 16, mbx, mby, top[:], left[:], &corner)
+	yMode, bestSAD := 0, -1
+	for mode := predDC; mode <= predHE; mode++ {
+		predictBlock(pred[:], 16, mode, mbx, mby, top[:], left[:], corner)
+		sad := 0
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				sad += abs(int(e.src.Y[(16*mby+y)*ys+16*mbx+x]) - int(pred[16*y+x]))
+			}
+		}
+		if bestSAD < 0 || sad < bestSAD {
+			yMode, bestSAD, best = mode, sad, pred
+		}
+	}
+
+	var coeffs [16][16]int32
+	var dc [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := 4*(n&3), 4*(n>>2)
+		var diff [16]int32
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				s := e.src.Y[(16*mby+by+y)*ys+16*mbx+bx+x]
+				diff[4*y+x] = int32(s) - int32(best[16*(by+y)+bx+x])
+			}
+		}
+		coeffs[n] = fdct(&diff)
+		dc[n] = coeffs[n][0]
+	}
+	wht := fwht(&dc)
+	var y2 [16]int32
+	for i := range wht {
+		y2[i] = quantize(wht[i], e.q.y2[btoi(i > 0)], 2)
+		wht[i] = y2[i] * e.q.y2[btoi(i > 0)]
+	}
+	nz := e.putCoeffs(&y2, planeY2, e.left.y16+e.up[mbx].y16, 0)
+	e.left.y16, e.up[mbx].y16 = nz, nz
+	dcRecon := iwht(&wht)
+
+	for n := 0; n < 16; n++ {
+		var levels [16]int32
+		for i := 1; i < 16; i++ {
+			levels[i] = quantize(coeffs[n][i], e.q.y1[1], 3)
+			coeffs[n][i] = levels[i] * e.q.y1[1]
+		}
+		x, y := n&3, n>>2
+		nz := e.putCoeffs(&levels, planeY1WithY2, e.left.mask[y]+e.up[mbx].mask[x], 1)
+		e.left.mask[y], e.up[mbx].mask[x] = nz, nz
+		coeffs[n][0] = dcRecon[n]
+		bx, by := 4*x, 4*y
+		idct(&coeffs[n], best[16*by+bx:], 16, e.recon.Y[(16*mby+by)*ys+16*mbx+bx:], ys)
+	}
+
+	// Цветность: один режим на обе плоскости.
+	var uTop, uLeft, vTop, vLeft [8]uint8
+	var uCorner, vCorner uint8
+	e.edges(e.recon.Cb, cs, 8, mbx, mby, uTop[:], uLeft[:], &uCorner)
+	e.edges(e.recon.Cr, cs, 8, mbx, mby, vTop[:], vLeft[:], &vCorner)
+	var uPred, vPred, uBest, vBest [8 * 8]uint8
+	cMode, bestSAD := 0, -1
+	for mode := predDC; mode <= predHE; mode++ {
+		predictBlock(uPred[:], 8, mode, mbx, mby, uTop[:], uLeft[:], uCorner)
+		predictBlock(vPred[:], 8, mode, mbx, mby, vTop[:], vLeft[:], vCorner)
+		sad := 0
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				i := (8*mby+y)*cs + 8*mbx + x
+				sad += abs(int(e.src.Cb[i])-int(uPred[8*y+x])) + abs(int(e.src.Cr[i])-int(vPred[8*y+x]))
+			}
+		}
+		if bestSAD < 0 || sad < bestSAD {
+			cMode, bestSAD, uBest, vBest = mode, sad, uPred, vPred
+		}
+	}
+	for c, plane := range []struct {
+		src, dst []uint8
+		pred     []uint8
+	}{
+		{e.src.Cb, e.recon.Cb, uBest[:]},
+		{e.src.Cr, e.recon.Cr, vBest[:]},
+	} {
+		for n := 0; n < 4; n++ {
+			x, y := n&1, n>>1
+			bx, by := 4*x, 4*y
+			var diff [16]int32
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					s := plane.src[(8*mby+by+j)*cs+8*mbx+bx+i]
+					diff[4*j+i] = int32(s) - int32(plane.pred[8*(by+j)+bx+i])
+				}
+			}
+			coeff := fdct(&diff)
+			var levels [16]int32
+			for i := range coeff {
+				levels[i] = quantize(coeff[i], e.q.uv[btoi(i > 0)], btoi(i > 0)+2)
+				coeff[i] = levels[i] * e.q.uv[btoi(i > 0)]
+			}
+			li, ui := 4+2*c+y, 4+2*c+x
+			nz := e.putCoeffs(&levels, planeUV, e.left.mask[li]+e.up[mbx].mask[ui], 0)
+			e.left.mask[li], e.up[mbx].mask[ui] = nz, nz
+			idct(&coeff, plane.pred[8*by+bx:], 8, plane.dst[(8*mby+by)*cs+8*mbx+bx:], cs)
+		}
+	}
+	e.modes = append(e.modes, [2]uint8{uint8(yMode), uint8(cMode)})
+}
+
+// edges заполняет верхнюю строку, левый столбец и угловой пиксель блока так
+// же, как это делает декодер: за краем кадра сверху 127, слева 129.
+func (e *vp8Encoder) edges(p []uint8, stride, size, mbx, mby int, top, left []uint8, corner *uint8) {
+	for i := 0; i < size; i++ {
+		if mby == 0 {
+			top[i] = 127
+		} else {
+			top[i] = p[(size*mby-1)*stride+size*mbx+i]
+		}
+		if mbx == 0 {
+			left[i] = 129
+		} else {
+			left[i] = p[(size*mby+i)*stride+size*mbx-1]
+		}
+	}
+	switch {
+	case mby == 0:
+		*corner = 127
+	case mbx == 0:
+		*corner = 129
+	default:
+		*corner = p[(size*mby-1)*stride+size*mbx-1]
+	}
+}
+
+func predictBlock(dst []uint8, size, mode, mbx, mby int, top, left []uint8, corner uint8) {
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var v int
+			switch mode {
+			case predVE:
+				v = int(top[x])
+			case predHE:
+				v = int(left[y])
+			case predTM:
+				v = clamp255(int(left[y]) + int(top[x]) - int(corner))
+			}
+			dst[size*y+x] = uint8(v)
+		}
+	}
+	if mode != predDC {
+		return
+	}
+	sum, n := 0, 0
+	if mby > 0 {
+		for _, v := range top[:size] {
+			sum += int(v)
+		}
+		n += size
+	}
+	if mbx > 0 {
+		for _, v := range left[:size] {
+			sum += int(v)
+		}
+		n += size
+	}
+	dc := uint8(0x80)
+	if n > 0 {
+		dc = uint8((sum + n/2) / n)
+	}
+	for i := range dst[:size*size] {
+		dst[i] = dc
+	}
+}
+
+// quantize делит коэффициент на шаг с округлением; bias задаёт долю шага
+// (1/bias), добавляемую перед делением, чем больше bias, тем шире мёртвая зона.
+func quantize(c, q, bias int32) int32 {
+	const maxLevel = 2047
+	sign := c < 0
+	if sign {
+		c = -c
+	}
+	l := (c + q/bias) / q
+	if l > maxLevel {
+		l = maxLevel
+	}
+	if sign {
+		return -l
+	}
+	return l
+}
+
+// fdct - прямое преобразование 4x4 в масштабе, согласованном с idct.
+func fdct(in *[16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		d0, d1, d2, d3 := in[4*i], in[4*i+1], in[4*i+2], in[4*i+3]
+		a0, a1, a2, a3 := d0+d3, d1+d2, d1-d2, d0-d3
+		tmp[4*i+0] = (a0 + a1) * 8
+		tmp[4*i+1] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[4*i+2] = (a0 - a1) * 8
+		tmp[4*i+3] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[i]+tmp[12+i], tmp[4+i]+tmp[8+i]
+		a2, a3 := tmp[4+i]-tmp[8+i], tmp[i]-tmp[12+i]
+		out[i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217+a3*5352+12000)>>16 + btoi(a3 != 0)
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// idct повторяет обратное преобразование декодера бит в бит.
+func idct(c *[16]int32, pred []uint8, predStride int, dst []uint8, stride int) {
+	const (
+		c1 = 85627
+		c2 = 35468
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i][0], m[i][1], m[i][2], m[i][3] = a+d, b+cc, b-cc, a-d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		r := [4]int32{(a + d) >> 3, (b + cc) >> 3, (b - cc) >> 3, (a - d) >> 3}
+		for i := 0; i < 4; i++ {
+			dst[j*stride+i] = uint8(clamp255(int(pred[j*predStride+i]) + int(r[i])))
+		}
+	}
+}
+
+func fwht(in *[16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := in[4*i]+in[4*i+2], in[4*i+1]+in[4*i+3]
+		a2, a3 := in[4*i+1]-in[4*i+3], in[4*i]-in[4*i+2]
+		tmp[4*i+0], tmp[4*i+1], tmp[4*i+2], tmp[4*i+3] = a0+a1, a3+a2, a3-a2, a0-a1
+	}
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[i]+tmp[8+i], tmp[4+i]+tmp[12+i]
+		a2, a3 := tmp[4+i]-tmp[12+i], tmp[i]-tmp[8+i]
+		out[i], out[4+i], out[8+i], out[12+i] = (a0+a1)>>1, (a3+a2)>>1, (a3-a2)>>1, (a0-a1)>>1
+	}
+	return out
+}
+
+// iwht повторяет обратное преобразование Уолша-Адамара декодера.
+func iwht(in *[16]int32) [16]int32 {
+	var m, out [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := in[i]+in[12+i], in[4+i]+in[8+i]
+		a2, a3 := in[4+i]-in[8+i], in[i]-in[12+i]
+		m[i], m[8+i], m[4+i], m[12+i] = a0+a1, a0-a1, a3+a2, a3-a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[4*i] + 3
+		a0, a1 := dc+m[4*i+3], m[4*i+1]+m[4*i+2]
+		a2, a3 := m[4*i+1]-m[4*i+2], dc-m[4*i+3]
+		out[4*i+0], out[4*i+1], out[4*i+2], out[4*i+3] = (a0+a1)>>3, (a3+a2)>>3, (a0-a1)>>3, (a3-a2)>>3
+	}
+	return out
+}
+
+// toYCbCr переводит изображение в YCbCr 4:2:0 (BT.601, ограниченный
+// диапазон, как в libwebp), дополняя его повтором краёв до целых макроблоков.
+func toYCbCr(img *image.NRGBA, mbw, mbh int) *image.YCbCr {
+	b := img.Bounds()
+	w, h := 16*mbw, 16*mbh
+	m := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	at := func(x, y int) (int, int, int) {
+		if x >= b.Dx() {
+			x = b.Dx() - 1
+		}
+		if y >= b.Dy() {
+			y = b.Dy() - 1
+		}
+		p := img.Pix[y*img.Stride+4*x:]
+		return int(p[0]), int(p[1]), int(p[2])
+	}
+	const fix, half = 16, 1 << 15
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl := at(x, y)
+			m.Y[y*m.YStride+x] = uint8((16839*r + 33059*g + 6420*bl + half + 16<<fix) >> fix)
+		}
+	}
+	for y := 0; y < h/2; y++ {
+		for x := 0; x < w/2; x++ {
+			var r, g, bl int
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := at(2*x+d[0], 2*y+d[1])
+				r, g, bl = r+pr, g+pg, bl+pb
+			}
+			i := y*m.CStride + x
+			m.Cb[i] = uint8(clamp255((-9719*r - 19081*g + 28800*bl + half<<2 + 128<<(fix+2)) >> (fix + 2)))
+			m.Cr[i] = uint8(clamp255((28800*r - 24116*g - 4684*bl + half<<2 + 128<<(fix+2)) >> (fix + 2)))
+		}
+	}
+	return m
+}
+
+func btoi(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,503 @@
+package webp
+
+import "image"
+
+// Lossless-кодирование VP8L: преобразование subtract green, предсказатель
+// по блокам 16x16 и энтропийное кодирование с обратными ссылками LZ77.
+
+const (
+	vp8lMagic      = 0x2f
+	predictorBits  = 4
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+	minRunLength   = 3
+	maxRunLength   = 4096
+	maxCodeLength  = 15
+	maxCLCodeLen   = 7
+
+	transformPredictor    = 0
+	transformSubtractGrn  = 2
+	nPlaneCodes           = 120
+	maxDistance           = 1<<20 - nPlaneCodes
+	hashBits              = 16
+	maxChain              = 32
+	codeLengthRepeatZero  = 17
+	codeLengthRepeatZeros = 18
+)
+
+// distanceMapTable - смещения (dy, 8-dx) для коротких кодов дистанции
+// (раздел 4.2.2 спецификации VP8L).
+var distanceMapTable = [nPlaneCodes]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Кандидаты для предсказателя: L, T, Average2(L, T), Select, ClampAddSubtractFull.
+var predictorModes = []int{1, 2, 7, 11, 12}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nBits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nBits -= 8
+	}
+}
+
+// writeCode пишет префиксный код: VP8L читает его со старшего бита.
+func (w *bitWriter) writeCode(code uint32, n uint) {
+	var r uint32
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | (code>>i)&1
+	}
+	w.write(r, n)
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		return append(w.buf, byte(w.acc))
+	}
+	return w.buf
+}
+
+func encodeVP8L(img *image.NRGBA) []byte {
+	b := img.Bounds()
+	bw := &bitWriter{}
+	bw.write(vp8lMagic, 8)
+	bw.write(uint32(b.Dx()-1), 14)
+	bw.write(uint32(b.Dy()-1), 14)
+	alpha := uint32(0)
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			alpha = 1
+			break
+		}
+	}
+	bw.write(alpha, 1)
+	bw.write(0, 3)
+	writeVP8LImage(bw, img)
+	return bw.bytes()
+}
+
+// writeVP8LImage пишет поток VP8L после заголовка: преобразования и пиксели.
+func writeVP8LImage(bw *bitWriter, img *image.NRGBA) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	pix := make([]byte, 4*w*h)
+	for y := 0; y < h; y++ {
+		copy(pix[4*w*y:4*w*(y+1)], img.Pix[y*img.Stride:y*img.Stride+4*w])
+	}
+
+	for p := 0; p < len(pix); p += 4 {
+		pix[p+0] -= pix[p+1]
+		pix[p+2] -= pix[p+1]
+	}
+	bw.write(1, 1)
+	bw.write(transformSubtractGrn, 2)
+
+	residuals, modes := predict(pix, w, h)
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	writePixels(bw, modes, tiles(w), false)
+
+	bw.write(0, 1)
+	writePixels(bw, residuals, w, true)
+}
+
+func tiles(size int) int {
+	return (size + 1<<predictorBits - 1) >> predictorBits
+}
+
+// predict выбирает для каждого блока режим предсказателя с наименьшей суммой
+// остатков и возвращает остатки и изображение режимов (режим в канале green).
+func predict(pix []byte, w, h int) ([]byte, []byte) {
+	tw, th := tiles(w), tiles(h)
+	modes := make([]byte, 4*tw*th)
+	res := make([]byte, len(pix))
+	var pred [4]byte
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				forTile(tx, ty, w, h, func(x, y int) {
+					if x == 0 || y == 0 {
+						return
+					}
+					p := 4 * (y*w + x)
+					predictPixel(pix, p, 4*w, mode, &pred)
+					for c := 0; c < 4; c++ {
+						cost += absResidual(pix[p+c] - pred[c])
+					}
+				})
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			q := 4 * (ty*tw + tx)
+			modes[q+1] = byte(best)
+			modes[q+3] = 0xff
+			forTile(tx, ty, w, h, func(x, y int) {
+				p := 4 * (y*w + x)
+				mode := best
+				switch {
+				case x == 0 && y == 0:
+					mode = 0
+				case y == 0:
+					mode = 1
+				case x == 0:
+					mode = 2
+				}
+				predictPixel(pix, p, 4*w, mode, &pred)
+				for c := 0; c < 4; c++ {
+					res[p+c] = pix[p+c] - pred[c]
+				}
+			})
+		}
+	}
+	return res, modes
+}
+
+func forTile(tx, ty, w, h int, f func(x, y int)) {
+	const size = 1 << predictorBits
+	for y := ty * size; y < (ty+1)*size && y < h; y++ {
+		for x := tx * size; x < (tx+1)*size && x < w; x++ {
+			f(x, y)
+		}
+	}
+}
+
+func predictPixel(pix []byte, p, stride, mode int, out *[4]byte) {
+	for c := 0; c < 4; c++ {
+		switch mode {
+		case 0:
+			out[c] = 0
+			if c == 3 {
+				out[c] = 0xff
+			}
+		case 1:
+			out[c] = pix[p-4+c]
+		case 2:
+			out[c] = pix[p-stride+c]
+		case 7:
+			out[c] = byte((int(pix[p-4+c]) + int(pix[p-stride+c])) / 2)
+		case 12:
+			v := int(pix[p-4+c]) + int(pix[p-stride+c]) - int(pix[p-stride-4+c])
+			out[c] = byte(clamp255(v))
+		}
+	}
+	if mode == 11 {
+		l, t := 0, 0
+		for c := 0; c < 4; c++ {
+			tl := int(pix[p-stride-4+c])
+			l += abs(tl - int(pix[p-stride+c]))
+			t += abs(tl - int(pix[p-4+c]))
+		}
+		src := p - stride
+		if l < t {
+			src = p - 4
+		}
+		copy(out[:], pix[src:src+4])
+	}
+}
+
+func absResidual(r byte) int {
+	return abs(int(int8(r)))
+}
+
+type token struct {
+	literal bool
+	argb    [4]byte // r, g, b, a
+	length  int
+	dist    int // код дистанции, а не расстояние в пикселях
+}
+
+// writePixels кодирует изображение как поток литералов и повторов.
+func writePixels(bw *bitWriter, pix []byte, w int, topLevel bool) {
+	tokens := tokenize(pix, w)
+
+	var (
+		green = make([]uint32, nLiteralCodes+nLengthCodes)
+		red   = make([]uint32, nLiteralCodes)
+		blue  = make([]uint32, nLiteralCodes)
+		alpha = make([]uint32, nLiteralCodes)
+		dist  = make([]uint32, nDistanceCodes)
+	)
+	for _, t := range tokens {
+		if t.literal {
+			red[t.argb[0]]++
+			green[t.argb[1]]++
+			blue[t.argb[2]]++
+			alpha[t.argb[3]]++
+			continue
+		}
+		ls, _, _ := prefixEncode(t.length)
+		ds, _, _ := prefixEncode(t.dist)
+		green[nLiteralCodes+ls]++
+		dist[ds]++
+	}
+
+	bw.write(0, 1) // без color cache
+	if topLevel {
+		bw.write(0, 1) // без meta prefix codes
+	}
+	codes := [5]huffmanCode{}
+	for i, hist := range [][]uint32{green, red, blue, alpha, dist} {
+		codes[i] = writeHuffmanCode(bw, hist)
+	}
+
+	for _, t := range tokens {
+		if t.literal {
+			codes[0].write(bw, int(t.argb[1]))
+			codes[1].write(bw, int(t.argb[0]))
+			codes[2].write(bw, int(t.argb[2]))
+			codes[3].write(bw, int(t.argb[3]))
+			continue
+		}
+		ls, extraBits, extra := prefixEncode(t.length)
+		codes[0].write(bw, nLiteralCodes+ls)
+		bw.write(extra, extraBits)
+		ds, extraBits, extra := prefixEncode(t.dist)
+		codes[4].write(bw, ds)
+		bw.write(extra, extraBits)
+	}
+}
+
+// tokenize жадно ищет самое длинное совпадение по цепочкам хэшей пар
+// пикселей.
+func tokenize(pix []byte, w int) []token {
+	n := len(pix) / 4
+	argb := make([]uint32, n)
+	for i := range argb {
+		argb[i] = uint32(pix[4*i])<<16 | uint32(pix[4*i+1])<<8 | uint32(pix[4*i+2]) | uint32(pix[4*i+3])<<24
+	}
+	codes := distanceCodes(w)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, n)
+	hash := func(i int) uint32 {
+		return (argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < n {
+			h := hash(i)
+			chain[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	match := func(i, j int) int {
+		l := 0
+		for i+l < n && l < maxRunLength && argb[i+l] == argb[j+l] {
+			l++
+		}
+		return l
+	}
+
+	tokens := make([]token, 0, n/2)
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+		// Соседи слева и сверху проверяются всегда: их коды самые короткие.
+		for _, d := range []int{1, w} {
+			if i >= d {
+				if l := match(i, i-d); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+		if i+1 < n {
+			for j, k := head[hash(i)], 0; j >= 0 && k < maxChain; j, k = chain[j], k+1 {
+				d := i - int(j)
+				if d > maxDistance {
+					break
+				}
+				if l := match(i, int(j)); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+		insert(i)
+		if bestLen < minRunLength {
+			t := token{literal: true}
+			copy(t.argb[:], pix[4*i:4*i+4])
+			tokens = append(tokens, t)
+			i++
+			continue
+		}
+		code, ok := codes[bestDist]
+		if !ok {
+			code = bestDist + nPlaneCodes
+		}
+		tokens = append(tokens, token{length: bestLen, dist: code})
+		for k := 1; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+	return tokens
+}
+
+// distanceCodes сопоставляет расстоянию в пикселях наименьший короткий код
+// дистанции для изображения шириной w.
+func distanceCodes(w int) map[int]int {
+	codes := make(map[int]int, nPlaneCodes)
+	for i, v := range distanceMapTable {
+		d := int(v>>4)*w + 8 - int(v&0xf)
+		if d < 1 {
+			d = 1
+		}
+		if _, ok := codes[d]; !ok {
+			codes[d] = i + 1
+		}
+	}
+	return codes
+}
+
+// prefixEncode возвращает префиксный символ и дополнительные биты значения
+// длины или дистанции (раздел 4.2.2 спецификации VP8L).
+func prefixEncode(v int) (symbol int, extraBits uint, extra uint32) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	n := v - 1
+	hb := 0
+	for 1<<(hb+1) <= n {
+		hb++
+	}
+	second := (n >> (hb - 1)) & 1
+	extraBits = uint(hb - 1)
+	return 2*hb + second, extraBits, uint32(n - (2+second)<<extraBits)
+}
+
+// writeHuffmanCode пишет префиксный код в поток и возвращает его.
+func writeHuffmanCode(bw *bitWriter, hist []uint32) huffmanCode {
+	var symbols []int
+	for s, c := range hist {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < nLiteralCodes) {
+		return writeSimpleCode(bw, hist, symbols)
+	}
+
+	code := newHuffmanCode(hist, maxCodeLength)
+	bw.write(0, 1)
+
+	// Длины кодов кодируются сами: литералы 0..15 и повторы нулей 17/18.
+	type clToken struct{ symbol, extra int }
+	var clTokens []clToken
+	clHist := make([]uint32, len(codeLengthCodeOrder))
+	for i := 0; i < len(code.lengths); {
+		l := int(code.lengths[i])
+		if l == 0 {
+			zeros := 0
+			for i+zeros < len(code.lengths) && code.lengths[i+zeros] == 0 && zeros < 138 {
+				zeros++
+			}
+			switch {
+			case zeros >= 11:
+				clTokens = append(clTokens, clToken{codeLengthRepeatZeros, zeros - 11})
+				clHist[codeLengthRepeatZeros]++
+				i += zeros
+				continue
+			case zeros >= 3:
+				clTokens = append(clTokens, clToken{codeLengthRepeatZero, zeros - 3})
+				clHist[codeLengthRepeatZero]++
+				i += zeros
+				continue
+			}
+		}
+		clTokens = append(clTokens, clToken{l, 0})
+		clHist[l]++
+		i++
+	}
+
+	clCode := newHuffmanCode(clHist, maxCLCodeLen)
+	nCodes := 4
+	for i, s := range codeLengthCodeOrder {
+		if clCode.lengths[s] > 0 && i+1 > nCodes {
+			nCodes = i + 1
+		}
+	}
+	bw.write(uint32(nCodes-4), 4)
+	for _, s := range codeLengthCodeOrder[:nCodes] {
+		bw.write(uint32(clCode.lengths[s]), 3)
+	}
+	bw.write(0, 1) // max_symbol не используется
+	for _, t := range clTokens {
+		clCode.write(bw, t.symbol)
+		switch t.symbol {
+		case codeLengthRepeatZero:
+			bw.write(uint32(t.extra), 3)
+		case codeLengthRepeatZeros:
+			bw.write(uint32(t.extra), 7)
+		}
+	}
+	return code
+}
+
+// writeSimpleCode пишет код из одного или двух символов меньше 256.
+func writeSimpleCode(bw *bitWriter, hist []uint32, symbols []int) huffmanCode {
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	bw.write(1, 1)
+	bw.write(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		bw.write(0, 1)
+		bw.write(uint32(symbols[0]), 1)
+	} else {
+		bw.write(1, 1)
+		bw.write(uint32(symbols[0]), 8)
+	}
+	code := huffmanCode{
+		lengths: make([]uint8, len(hist)),
+		codes:   make([]uint16, len(hist)),
+		single:  len(symbols) == 1,
+	}
+	if len(symbols) == 2 {
+		bw.write(uint32(symbols[1]), 8)
+		code.lengths[symbols[0]], code.lengths[symbols[1]] = 1, 1
+		code.codes[symbols[1]] = 1
+	}
+	return code
+}
+
+func clamp255(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,154 @@
+// Package webp реализует кодирование изображений в формат WebP без cgo:
+// lossless (VP8L) и lossy (VP8 с каналом прозрачности в чанке ALPH).
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+const DefaultQuality = 75
+
+const (
+	maxVP8Size  = 1<<14 - 1
+	maxVP8LSize = 1 << 14
+)
+
+var ErrTooLarge = errors.New("webp: image is too large")
+
+type Options struct {
+	Lossless bool
+	Quality  float32 // 0..100, используется только для lossy
+	EXIF     []byte  // метаданные EXIF (TIFF-структура) для чанка EXIF
+}
+
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{Quality: DefaultQuality}
+	}
+	img := toNRGBA(m)
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("webp: empty image")
+	}
+
+	var (
+		chunks []chunk
+		flags  byte
+	)
+	if o.Lossless {
+		if b.Dx() > maxVP8LSize || b.Dy() > maxVP8LSize {
+			return ErrTooLarge
+		}
+		// Флаг альфы не ставится: прозрачность VP8L хранится в самом потоке,
+		// а декодер x/image отвергает VP8L при выставленном флаге.
+		chunks = append(chunks, chunk{"VP8L", encodeVP8L(img)})
+	} else {
+		if b.Dx() > maxVP8Size || b.Dy() > maxVP8Size {
+			return ErrTooLarge
+		}
+		data, _ := encodeVP8(img, o.Quality)
+		if alpha, ok := encodeAlpha(img); ok {
+			flags |= alphaFlag
+			chunks = append(chunks, chunk{"ALPH", alpha})
+		}
+		chunks = append(chunks, chunk{"VP8 ", data})
+	}
+	if len(o.EXIF) > 0 {
+		flags |= exifFlag
+		chunks = append(chunks, chunk{"EXIF", o.EXIF})
+	}
+	// Простой формат допускает только один чанк с битовым потоком.
+	if len(chunks) > 1 {
+		chunks = append([]chunk{{"VP8X", vp8xHeader(b.Dx(), b.Dy(), flags)}}, chunks...)
+	}
+	return writeRIFF(w, chunks)
+}
+
+type chunk struct {
+	id   string
+	data []byte
+}
+
+func writeRIFF(w io.Writer, chunks []chunk) error {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+	buf := make([]byte, 0, size+8)
+	buf = append(buf, "RIFF"...)
+	buf = appendUint32(buf, uint32(size))
+	buf = append(buf, "WEBP"...)
+	for _, c := range chunks {
+		buf = append(buf, c.id...)
+		buf = appendUint32(buf, uint32(len(c.data)))
+		buf = append(buf, c.data...)
+		if len(c.data)&1 == 1 {
+			buf = append(buf, 0)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Флаги заголовка VP8X.
+const (
+	exifFlag  = 0x08
+	alphaFlag = 0x10
+)
+
+func vp8xHeader(width, height int, flags byte) []byte {
+	h := make([]byte, 10)
+	h[0] = flags
+	put24(h[4:], uint32(width-1))
+	put24(h[7:], uint32(height-1))
+	return h
+}
+
+// encodeAlpha упаковывает канал прозрачности в чанк ALPH (сжатие VP8L без
+// заголовка). Для непрозрачного изображения чанк не нужен.
+func encodeAlpha(img *image.NRGBA) ([]byte, bool) {
+	b := img.Bounds()
+	opaque := true
+	a := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			v := img.Pix[y*img.Stride+4*x+3]
+			if v != 0xff {
+				opaque = false
+			}
+			a.Pix[y*a.Stride+4*x+1] = v
+			a.Pix[y*a.Stride+4*x+3] = 0xff
+		}
+	}
+	if opaque {
+		return nil, false
+	}
+	const compressionLossless = 1
+	bw := &bitWriter{}
+	writeVP8LImage(bw, a)
+	return append([]byte{compressionLossless}, bw.bytes()...), true
+}
+
+func toNRGBA(m image.Image) *image.NRGBA {
+	if n, ok := m.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := m.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), m, b.Min, draw.Src)
+	return n
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var t [4]byte
+	binary.LittleEndian.PutUint32(t[:], v)
+	return append(b, t[:]...)
+}
+
+func put24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,147 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+)
+
+func testImage(w, h int, alpha bool) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8(128 + 100*math.Sin(float64(x+y)/7)),
+				A: 255,
+			}
+			if x > w/3 && x < w/2 && y > h/3 && y < h/2 {
+				c = color.NRGBA{R: 250, G: 20, B: 20, A: 255}
+			}
+			if alpha {
+				c.A = uint8(x * 255 / w)
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestEncodeLossless(t *testing.T) {
+	table := []struct {
+		w, h  int
+		alpha bool
+		msg   string
+	}{
+		{w: 1, h: 1, msg: "Single pixel"},
+		{w: 37, h: 21, msg: "Odd size"},
+		{w: 200, h: 120, alpha: true, msg: "With alpha"},
+		{w: 64, h: 64, msg: "Tile-aligned size"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			src := testImage(dat.w, dat.h, dat.alpha)
+			var buf bytes.Buffer
+			require.NoError(t, Encode(&buf, src, &Options{Lossless: true}))
+			m, err := webp.Decode(&buf)
+			require.NoError(t, err)
+			require.Equal(t, src.Bounds(), m.Bounds())
+			require.Equal(t, src.Pix, m.(*image.NRGBA).Pix)
+		})
+	}
+}
+
+func TestEncodeLosslessUniform(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, src, &Options{Lossless: true}))
+	require.Less(t, buf.Len(), 200, "uniform image must be packed by repeats")
+	m, err := webp.Decode(&buf)
+	require.NoError(t, err)
+	require.Equal(t, src.Pix, m.(*image.NRGBA).Pix)
+}
+
+func TestEncodeLossy(t *testing.T) {
+	table := []struct {
+		w, h    int
+		quality float32
+		msg     string
+	}{
+		{w: 1, h: 1, quality: 75, msg: "Single pixel"},
+		{w: 37, h: 21, quality: 75, msg: "Odd size"},
+		{w: 160, h: 96, quality: 100, msg: "Best quality"},
+		{w: 160, h: 96, quality: 0, msg: "Worst quality"},
+	}
+
+	for _, dat := range table {
+		t.Run(dat.msg, func(t *testing.T) {
+			src := testImage(dat.w, dat.h, false)
+			data, recon := encodeVP8(src, dat.quality)
+			var buf bytes.Buffer
+			require.NoError(t, writeRIFF(&buf, []chunk{{"VP8 ", data}}))
+			m, err := webp.Decode(&buf)
+			require.NoError(t, err)
+			y := m.(*image.YCbCr)
+			require.Equal(t, src.Bounds(), y.Bounds())
+			// Декодер должен получить в точности то, что восстановил кодер.
+			for j := 0; j < dat.h; j++ {
+				require.Equal(t, recon.Y[j*recon.YStride:j*recon.YStride+dat.w], y.Y[j*y.YStride:j*y.YStride+dat.w])
+			}
+			for j := 0; j < (dat.h+1)/2; j++ {
+				cw := (dat.w + 1) / 2
+				require.Equal(t, recon.Cb[j*recon.CStride:j*recon.CStride+cw], y.Cb[j*y.CStride:j*y.CStride+cw])
+				require.Equal(t, recon.Cr[j*recon.CStride:j*recon.CStride+cw], y.Cr[j*y.CStride:j*y.CStride+cw])
+			}
+		})
+	}
+}
+
+func TestEncodeLossyQuality(t *testing.T) {
+	src := testImage(256, 256, false)
+	psnr := func(q float32) (float64, int) {
+		data, recon := encodeVP8(src, q)
+		ref := toYCbCr(src, 16, 16)
+		var sum float64
+		for i := range ref.Y {
+			d := float64(ref.Y[i]) - float64(recon.Y[i])
+			sum += d * d
+		}
+		return 10 * math.Log10(255*255/(sum/float64(len(ref.Y)))), len(data)
+	}
+	hi, hiSize := psnr(90)
+	lo, loSize := psnr(30)
+	require.Greater(t, hi, 38.0)
+	require.Greater(t, lo, 28.0)
+	require.Greater(t, hi, lo)
+	require.Greater(t, hiSize, loSize)
+}
+
+func TestEncodeLossyAlpha(t *testing.T) {
+	src := testImage(50, 30, true)
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, src, &Options{Quality: 80}))
+	m, err := webp.Decode(&buf)
+	require.NoError(t, err)
+	a, ok := m.(*image.NYCbCrA)
+	require.True(t, ok, "alpha channel must be kept")
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 50; x++ {
+			require.Equal(t, src.Pix[y*src.Stride+4*x+3], a.A[y*a.AStride+x])
+		}
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, maxVP8Size+1, 1))
+	require.Equal(t, ErrTooLarge, Encode(&bytes.Buffer{}, src, nil))
+}